@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -12,9 +14,12 @@ import (
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
+
+	"platform/clientauth"
 )
 
-const gatewayURL = "http://localhost:8090"
+// api is the gateway every request is sent to; main sets it up.
+var api *clientauth.Client
 
 type User struct {
 	ID    string `json:"id"`
@@ -41,8 +46,7 @@ type Invoice struct {
 }
 
 func makeRequest(endpoint string) (string, error) {
-	url := gatewayURL + endpoint
-	resp, err := http.Get(url)
+	resp, err := api.Get(endpoint)
 	if err != nil {
 		return "", err
 	}
@@ -68,6 +72,13 @@ func makeRequest(endpoint string) (string, error) {
 }
 
 func main() {
+	gateway := flag.String("gateway", "", "gateway to send requests to; by default SBA_GATEWAY_URL, one found in the registry at REGISTRY_URL or http://localhost:8090")
+	flag.Parse()
+	if *gateway == "" {
+		*gateway = clientauth.FindGateway(os.Getenv("REGISTRY_URL"))
+	}
+	api = clientauth.New(*gateway)
+
 	myApp := app.New()
 	myWindow := myApp.NewWindow("Sistema SBA - API Gateway Dashboard")
 	myWindow.Resize(fyne.NewSize(900, 650))
@@ -93,7 +104,7 @@ func main() {
 	// Function to make API calls
 	makeAPICall := func(endpoint, description string) {
 		statusLabel.SetText(fmt.Sprintf("🔄 %s...", description))
-		requestInfo.SetText(fmt.Sprintf("Endpoint: %s%s", gatewayURL, endpoint))
+		requestInfo.SetText(fmt.Sprintf("Endpoint: %s%s", api.URL, endpoint))
 		progressBar.Show()
 		output.SetText("Carregando...")
 
@@ -129,10 +140,15 @@ func main() {
 		makeAPICall("/api/user?id=2", "Buscando usuário 2")
 	})
 
+	btnProfile1 := widget.NewButton("🗂️ Perfil Completo do Usuário 1", func() {
+		makeAPICall("/api/profile?user_id=1", "Buscando perfil completo do usuário 1")
+	})
+
 	usersBox := container.NewVBox(
 		usersLabel,
 		btnListUsers,
 		container.NewGridWithColumns(2, btnUser1, btnUser2),
+		btnProfile1,
 	)
 
 	// === ORDERS SECTION ===
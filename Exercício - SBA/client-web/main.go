@@ -4,18 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 	"time"
-)
 
-const (
-	gatewayURL = "http://localhost:8090"
-	webPort    = ":3000"
+	"platform/clientauth"
+	"platform/server"
 )
 
+// api is the gateway every request is sent to; main sets it up.
+var api *clientauth.Client
+
 // Proxy handler to avoid CORS issues
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	// Enable CORS
@@ -36,12 +40,10 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Make request to gateway
-	targetURL := gatewayURL + endpoint
-	log.Printf("[WEB CLIENT] Proxying request to: %s\n", targetURL)
-
-	resp, err := http.Get(targetURL)
+	targetURL := api.URL + endpoint
+	resp, err := api.Get(endpoint)
 	if err != nil {
-		log.Printf("[WEB CLIENT] Error: %v\n", err)
+		slog.Error("proxying request", "url", targetURL, "error", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadGateway)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -50,6 +52,8 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer resp.Body.Close()
+	// The gateway's request ID finds the matching lines in its logs.
+	slog.Info("proxied request", "url", targetURL, "status", resp.StatusCode, "request_id", resp.Header.Get("X-Request-ID"))
 
 	// Read response
 	body, err := io.ReadAll(resp.Body)
@@ -75,22 +79,37 @@ func openBrowser(url string) {
 		err = exec.Command("open", url).Start()
 	}
 	if err != nil {
-		log.Printf("Não foi possível abrir o navegador automaticamente. Acesse: %s\n", url)
+		slog.Warn("Não foi possível abrir o navegador automaticamente", "url", url)
 	}
 }
 
 func main() {
+	srvFlags := server.DefineFlags(":3000")
+	gateway := server.EnvString("gateway", "SBA_GATEWAY_URL", "", "gateway to send requests to; by default one found in the registry or http://localhost:8090")
+	registry := server.EnvString("registry", "REGISTRY_URL", "", "service registry to find the gateway in")
+	flagErr := server.ParseFlags()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)).With("service", "web-client"))
+	if flagErr != nil {
+		slog.Error("invalid settings", "error", flagErr)
+		os.Exit(1)
+	}
+	if *gateway == "" {
+		*gateway = clientauth.FindGateway(*registry)
+	}
+	api = clientauth.New(*gateway)
+
 	// Serve static HTML
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Write([]byte(htmlContent))
+		w.Write([]byte(strings.ReplaceAll(htmlContent, "{{GATEWAY_URL}}", api.URL)))
 	})
 
 	// API proxy endpoint
 	http.HandleFunc("/api/proxy", proxyHandler)
 
 	// Server info
-	serverURL := fmt.Sprintf("http://localhost%s", webPort)
+	_, port, _ := net.SplitHostPort(*srvFlags.Addr)
+	serverURL := "http://localhost:" + port
 
 	fmt.Println("╔══════════════════════════════════════════════════════════╗")
 	fmt.Println("║         API Gateway - Dashboard Web                     ║")
@@ -98,7 +117,7 @@ func main() {
 	fmt.Println("╚══════════════════════════════════════════════════════════╝")
 	fmt.Println("")
 	fmt.Printf("🌐 Dashboard disponível em: %s\n", serverURL)
-	fmt.Println("📡 Gateway esperado em: http://localhost:8090")
+	fmt.Printf("📡 Gateway esperado em: %s\n", api.URL)
 	fmt.Println("")
 	fmt.Println("Abrindo navegador...")
 	fmt.Println("")
@@ -112,7 +131,10 @@ func main() {
 		openBrowser(serverURL)
 	}()
 
-	log.Fatal(http.ListenAndServe(webPort, nil))
+	if err := server.Serve(srvFlags.Server(http.DefaultServeMux), *srvFlags.ShutdownTimeout, func() {}); err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
 }
 
 const htmlContent = `<!DOCTYPE html>
@@ -338,6 +360,9 @@ const htmlContent = `<!DOCTYPE html>
                     <button class="btn" onclick="makeRequest('/api/user?id=2', 'Buscando usuário ID 2')">
                         👤 Usuário ID: 2
                     </button>
+                    <button class="btn" onclick="makeRequest('/api/profile?user_id=1', 'Perfil completo do usuário 1')">
+                        🗂️ Perfil Completo do Usuário 1
+                    </button>
                 </div>
 
                 <div class="section">
@@ -401,7 +426,7 @@ const htmlContent = `<!DOCTYPE html>
         </div>
 
         <div class="footer">
-            💡 Gateway: http://localhost:8090 | Users: 8081 | Orders: 8082 | Billing: 8083
+            💡 Gateway: {{GATEWAY_URL}} | Users: 8081 | Orders: 8082 | Billing: 8083
         </div>
     </div>
 
@@ -415,7 +440,7 @@ const htmlContent = `<!DOCTYPE html>
 
             // Update status
             statusEl.textContent = '\uD83D\uDD04 ' + description + '...';
-            endpointEl.textContent = 'Endpoint: http://localhost:8090' + endpoint;
+            endpointEl.textContent = 'Endpoint: {{GATEWAY_URL}}' + endpoint;
 
             // Show loading
             responseEl.innerHTML = '<div class="loading"><div class="spinner"></div>Carregando...</div>';
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
 	"time"
+
+	"platform/clientauth"
 )
 
-const gatewayURL = "http://localhost:8090"
+// api is the gateway every request is sent to; main sets it up.
+var api *clientauth.Client
 
 func makeRequest(endpoint string, description string) {
 	fmt.Println("\n" + strings.Repeat("=", 60))
@@ -17,8 +22,7 @@ func makeRequest(endpoint string, description string) {
 	fmt.Printf("Endpoint: %s\n", endpoint)
 	fmt.Println(strings.Repeat("=", 60))
 
-	url := gatewayURL + endpoint
-	resp, err := http.Get(url)
+	resp, err := api.Get(endpoint)
 	if err != nil {
 		log.Printf("Error making request: %v\n", err)
 		return
@@ -39,7 +43,14 @@ func makeRequest(endpoint string, description string) {
 }
 
 func main() {
-	fmt.Println("\n")
+	gateway := flag.String("gateway", "", "gateway to send requests to; by default SBA_GATEWAY_URL, one found in the registry at REGISTRY_URL or http://localhost:8090")
+	flag.Parse()
+	if *gateway == "" {
+		*gateway = clientauth.FindGateway(os.Getenv("REGISTRY_URL"))
+	}
+	api = clientauth.New(*gateway)
+
+	fmt.Print("\n\n")
 	fmt.Println("╔══════════════════════════════════════════════════════════╗")
 	fmt.Println("║         UI CLIENT - Simulador de Interface              ║")
 	fmt.Println("║         Padrão API Gateway - Arquitetura SBA            ║")
@@ -73,10 +84,13 @@ func main() {
 	// 8. Get invoices by user
 	makeRequest("/api/invoices/user?user_id=1", "Listar faturas do usuário ID 1")
 
-	// 9. Test invalid route
+	// 9. Get the full profile (user, orders and invoices) in one call
+	makeRequest("/api/profile?user_id=1", "Perfil completo do usuário ID 1")
+
+	// 10. Test invalid route
 	makeRequest("/api/invalid", "Testar rota inválida (erro esperado)")
 
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 	fmt.Println("╔══════════════════════════════════════════════════════════╗")
 	fmt.Println("║            Simulação Concluída!                          ║")
 	fmt.Println("╚══════════════════════════════════════════════════════════╝")
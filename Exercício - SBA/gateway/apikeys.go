@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/authz"
+	"platform/httpjson"
+)
+
+// headerAPIKey carries the API key of machine clients.
+const headerAPIKey = "X-API-Key"
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognize.
+const apiKeyPrefix = "sba_"
+
+// usageFlushInterval is how often changed usage counters are saved.
+const usageFlushInterval = 10 * time.Second
+
+var (
+	errUnknownAPIKey = errors.New("unknown API key")
+	errAPIKeyRevoked = errors.New("API key revoked")
+	errAPIKeyExpired = errors.New("API key expired")
+	errAPIKeyScope   = errors.New("API key is not allowed on this route")
+)
+
+// apiKeyScope allows a key on the paths starting with Prefix, for the listed
+// methods (every method when empty).
+type apiKeyScope struct {
+	Prefix  string   `json:"prefix"`
+	Methods []string `json:"methods,omitempty"`
+}
+
+func (s apiKeyScope) allows(method, path string) bool {
+	if !strings.HasPrefix(path, s.Prefix) {
+		return false
+	}
+	return len(s.Methods) == 0 || slices.Contains(s.Methods, method) ||
+		(method == http.MethodHead && slices.Contains(s.Methods, http.MethodGet))
+}
+
+// apiKeyInfo is what the admin endpoints show of a key. The key itself is
+// only returned once, when it is issued.
+type apiKeyInfo struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	Hint       string        `json:"hint"`
+	Roles      []string      `json:"roles"`
+	Scopes     []apiKeyScope `json:"scopes"`
+	CreatedAt  time.Time     `json:"created_at"`
+	CreatedBy  string        `json:"created_by"`
+	ExpiresAt  *time.Time    `json:"expires_at,omitempty"`
+	RevokedAt  *time.Time    `json:"revoked_at,omitempty"`
+	Requests   int64         `json:"requests"`
+	LastUsedAt *time.Time    `json:"last_used_at,omitempty"`
+}
+
+// apiKey is a stored key: only the SHA-256 of the key is kept.
+type apiKey struct {
+	apiKeyInfo
+	Hash string `json:"hash"`
+}
+
+// subject is the identity a key is forwarded upstream as.
+func (k *apiKey) subject() string { return "apikey:" + k.ID }
+
+// apiKeyStore holds the API keys, saved as a JSON file.
+type apiKeyStore struct {
+	path string
+
+	mu     sync.Mutex
+	keys   map[string]*apiKey // by ID
+	byHash map[string]*apiKey
+	dirty  bool
+}
+
+// apiKeys is the store used to authenticate requests; nil until main opens
+// it.
+var apiKeys *apiKeyStore
+
+// openAPIKeys loads the keys saved at path, if any, and starts saving the
+// usage counters in the background.
+func openAPIKeys(path string) (*apiKeyStore, error) {
+	s := &apiKeyStore{path: path, keys: map[string]*apiKey{}, byHash: map[string]*apiKey{}}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		var keys []*apiKey
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, k := range keys {
+			s.keys[k.ID] = k
+			s.byHash[k.Hash] = k
+		}
+	}
+	go s.flushUsage()
+	return s, nil
+}
+
+// authenticate returns the identity of the key sent for a request with the
+// given method and path, and counts its use.
+func (s *apiKeyStore) authenticate(key, method, path string, now time.Time) (*identity, error) {
+	sum := sha256.Sum256([]byte(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byHash[hex.EncodeToString(sum[:])]
+	switch {
+	case !ok:
+		return nil, errUnknownAPIKey
+	case k.RevokedAt != nil:
+		return nil, errAPIKeyRevoked
+	case k.ExpiresAt != nil && now.After(*k.ExpiresAt):
+		return nil, errAPIKeyExpired
+	}
+	id := &identity{Subject: k.subject(), Roles: k.Roles}
+	if !slices.ContainsFunc(k.Scopes, func(sc apiKeyScope) bool { return sc.allows(method, path) }) {
+		return id, errAPIKeyScope
+	}
+	k.Requests++
+	k.LastUsedAt = &now
+	s.dirty = true
+	return id, nil
+}
+
+// issue creates a key and returns it along with its stored form.
+func (s *apiKeyStore) issue(info apiKeyInfo) (string, apiKeyInfo, error) {
+	id, err := randomString(6)
+	if err != nil {
+		return "", apiKeyInfo{}, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", apiKeyInfo{}, err
+	}
+	key := apiKeyPrefix + id + "_" + secret
+	sum := sha256.Sum256([]byte(key))
+
+	info.ID = id
+	info.Hint = apiKeyPrefix + id + "_" + secret[:4] + "…"
+	k := &apiKey{apiKeyInfo: info, Hash: hex.EncodeToString(sum[:])}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	s.byHash[k.Hash] = k
+	if err := s.save(); err != nil {
+		delete(s.keys, k.ID)
+		delete(s.byHash, k.Hash)
+		return "", apiKeyInfo{}, err
+	}
+	return key, k.apiKeyInfo, nil
+}
+
+// revoke stops a key from being accepted. Revoked keys stay listed.
+func (s *apiKeyStore) revoke(id string, now time.Time) (apiKeyInfo, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return apiKeyInfo{}, false, nil
+	}
+	if k.RevokedAt == nil {
+		k.RevokedAt = &now
+		if err := s.save(); err != nil {
+			k.RevokedAt = nil
+			return apiKeyInfo{}, true, err
+		}
+	}
+	return k.apiKeyInfo, true, nil
+}
+
+func (s *apiKeyStore) get(id string) (apiKeyInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return apiKeyInfo{}, false
+	}
+	return k.apiKeyInfo, true
+}
+
+// list returns every key, oldest first.
+func (s *apiKeyStore) list() []apiKeyInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]apiKeyInfo, 0, len(s.keys))
+	for _, k := range s.keys {
+		out = append(out, k.apiKeyInfo)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// save writes every key to the file, replacing it atomically. s.mu must be
+// held.
+func (s *apiKeyStore) save() error {
+	keys := make([]*apiKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// flushUsage saves the usage counters whenever they changed. It never
+// returns.
+func (s *apiKeyStore) flushUsage() {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		if s.dirty {
+			if err := s.save(); err != nil {
+				slog.Error("saving API key usage", "error", err)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// close saves the usage counters not yet written, on shutdown.
+func (s *apiKeyStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// randomString returns n random bytes encoded as base64url.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// apiKeyRequest is the body accepted by POST /admin/api-keys.
+type apiKeyRequest struct {
+	Name      string        `json:"name"`
+	Roles     []string      `json:"roles"`
+	Scopes    []apiKeyScope `json:"scopes"`
+	ExpiresIn Duration      `json:"expires_in,omitempty"`
+}
+
+func (req apiKeyRequest) validate() error {
+	var errs []error
+	if strings.TrimSpace(req.Name) == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	for _, role := range req.Roles {
+		if !slices.Contains(knownRoles, role) {
+			errs = append(errs, fmt.Errorf("unknown role %q", role))
+		}
+	}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, errors.New("at least one scope is required"))
+	}
+	for _, sc := range req.Scopes {
+		if !strings.HasPrefix(sc.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("scope prefix %q must start with /", sc.Prefix))
+		}
+		for _, m := range sc.Methods {
+			if !knownMethods[m] {
+				errs = append(errs, fmt.Errorf("scope %s: unsupported method %q", sc.Prefix, m))
+			}
+		}
+	}
+	if req.ExpiresIn < 0 {
+		errs = append(errs, errors.New("expires_in must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// requireAdmin lets through only callers authenticated with a user token
+// holding the admin role. Otherwise it writes 401 or 403 and returns false.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	table := currentRoutes.Load()
+	if table.verifier == nil {
+		http.Error(w, "API keys require authentication to be configured", http.StatusNotFound)
+		return nil, false
+	}
+	r, ok := table.authenticate(w, r, false)
+	if !ok {
+		return nil, false
+	}
+	id := identityFrom(r.Context())
+	if strings.HasPrefix(id.Subject, "apikey:") || !slices.Contains(id.Roles, "admin") {
+		reason := "API keys are managed by admin users only"
+		authz.Audit(r, id.caller(), http.StatusForbidden, reason)
+		http.Error(w, "Forbidden: "+reason, http.StatusForbidden)
+		return nil, false
+	}
+	return r, true
+}
+
+// listAPIKeys handles GET /admin/api-keys.
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	httpjson.Write(w, http.StatusOK, apiKeys.list())
+}
+
+// getAPIKey handles GET /admin/api-keys/{id}.
+func getAPIKey(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	info, ok := apiKeys.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, info)
+}
+
+// issueAPIKey handles POST /admin/api-keys. The key is in the response and
+// cannot be retrieved again.
+func issueAPIKey(w http.ResponseWriter, r *http.Request) {
+	r, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var req apiKeyRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, "Invalid API key request: "+strings.ReplaceAll(err.Error(), "\n", "; "), http.StatusUnprocessableEntity)
+		return
+	}
+
+	now := time.Now().UTC()
+	info := apiKeyInfo{
+		Name:      strings.TrimSpace(req.Name),
+		Roles:     req.Roles,
+		Scopes:    req.Scopes,
+		CreatedAt: now,
+		CreatedBy: identityFrom(r.Context()).Subject,
+	}
+	if req.ExpiresIn > 0 {
+		expires := now.Add(time.Duration(req.ExpiresIn))
+		info.ExpiresAt = &expires
+	}
+	key, info, err := apiKeys.issue(info)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "issuing API key", "error", err)
+		http.Error(w, "Could not issue the API key", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "API key issued", "key_id", info.ID, "name", info.Name, "by", info.CreatedBy)
+	w.Header().Set("Cache-Control", "no-store")
+	httpjson.Write(w, http.StatusCreated, struct {
+		Key string `json:"key"`
+		apiKeyInfo
+	}{key, info})
+}
+
+// revokeAPIKey handles DELETE /admin/api-keys/{id}.
+func revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	r, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	info, found, err := apiKeys.revoke(r.PathValue("id"), time.Now().UTC())
+	switch {
+	case !found:
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "revoking API key", "error", err)
+		http.Error(w, "Could not revoke the API key", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "API key revoked", "key_id", info.ID, "name", info.Name, "by", identityFrom(r.Context()).Subject)
+	httpjson.Write(w, http.StatusOK, info)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"platform/authz"
+)
+
+// knownRoles are the roles that access rules may name.
+var knownRoles = []string{"customer", "support", "admin"}
+
+// identity is the authenticated caller of a request.
+type identity struct {
+	Subject string
+	Roles   []string
+}
+
+// caller is id as the audit log records it; nil is an anonymous caller.
+func (id *identity) caller() authz.Caller {
+	if id == nil {
+		return authz.Caller{}
+	}
+	return authz.Caller{Subject: id.Subject, Roles: id.Roles}
+}
+
+type identityKey struct{}
+
+// identityFrom returns the caller authenticated for ctx, or nil.
+func identityFrom(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
+
+// authenticate strips caller-supplied identity headers from r and, unless
+// the request is public, requires a valid bearer token or API key. It returns
+// the request to forward, carrying the verified identity in its context and
+// headers; when authentication fails a 401 (or a 403 for an API key used
+// outside its scopes, or a 429 when the caller's IP address presents
+// credentials too often) has been written and ok is false. Without an auth
+// section in the configuration every request is let through.
+func (t *routeTable) authenticate(w http.ResponseWriter, r *http.Request, public bool) (_ *http.Request, ok bool) {
+	for _, name := range []string{authz.HeaderSubject, authz.HeaderRoles, authz.HeaderService, authz.HeaderServiceToken} {
+		r.Header.Del(name)
+	}
+	// The key is a secret between the client and the gateway.
+	key := r.Header.Get(headerAPIKey)
+	r.Header.Del(headerAPIKey)
+	if t.verifier == nil || public {
+		return r, true
+	}
+	if !t.limitAuth(w, r) {
+		return nil, false
+	}
+
+	var id *identity
+	var err error
+	if key != "" && r.Header.Get("Authorization") == "" {
+		id, err = t.authenticateKey(key, r)
+		if errors.Is(err, errAPIKeyScope) {
+			authz.Audit(r, id.caller(), http.StatusForbidden, err.Error())
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return nil, false
+		}
+	} else {
+		id, err = t.authenticateToken(r)
+	}
+	if err != nil {
+		challenge := `Bearer realm="sba"`
+		if !errors.Is(err, errNoToken) {
+			challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, err.Error())
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		slog.InfoContext(r.Context(), "authentication failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		return nil, false
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+	r.Header.Set(authz.HeaderSubject, id.Subject)
+	if len(id.Roles) > 0 {
+		r.Header.Set(authz.HeaderRoles, strings.Join(id.Roles, ","))
+	}
+	return r, true
+}
+
+// authenticateToken verifies the bearer token of r.
+func (t *routeTable) authenticateToken(r *http.Request) (*identity, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := t.verifier.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &identity{Subject: claims.Subject, Roles: claims.Roles}, nil
+}
+
+// authenticateKey looks up the API key sent with r.
+func (t *routeTable) authenticateKey(key string, r *http.Request) (*identity, error) {
+	if apiKeys == nil {
+		return nil, errUnknownAPIKey
+	}
+	return apiKeys.authenticate(key, r.Method, r.URL.Path, time.Now())
+}
+
+// bearerToken extracts the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", errNoToken
+	}
+	scheme, token, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", errors.New("authorization header must use the Bearer scheme")
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// authorize applies the route's access rules to the caller of r. When the
+// caller lacks every allowed role a 403 is written, the denial is audited
+// and ok is false. Requests without an identity (public routes, or
+// authentication turned off) are not restricted.
+func (rt *route) authorize(w http.ResponseWriter, r *http.Request) (ok bool) {
+	id := identityFrom(r.Context())
+	if id == nil {
+		return true
+	}
+	allowed := rt.Access.Write
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		allowed = rt.Access.Read
+	}
+	if len(allowed) == 0 || slices.ContainsFunc(id.Roles, func(role string) bool { return slices.Contains(allowed, role) }) {
+		return true
+	}
+	reason := "requires role " + strings.Join(allowed, " or ")
+	authz.Audit(r, id.caller(), http.StatusForbidden, reason)
+	http.Error(w, "Forbidden: "+reason, http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies accepted in UpstreamConfig.Strategy.
+const (
+	strategyRoundRobin       = "round_robin"
+	strategyLeastConnections = "least_connections"
+	strategyWeighted         = "weighted"
+)
+
+// Passive ejection defaults, used when the upstream does not set them.
+const (
+	defaultEjectAfter = 3
+	defaultEjectFor   = 30 * time.Second
+)
+
+var errNoInstance = errors.New("no instance available")
+
+// instance is one server of an upstream pool.
+type instance struct {
+	url    *url.URL
+	weight int
+
+	// active counts requests currently being served by the instance.
+	active atomic.Int64
+
+	mu                sync.Mutex
+	consecutiveErrors int
+	ejectedUntil      time.Time
+	health            healthState
+}
+
+// available reports whether the instance may receive traffic at now: it
+// must pass its health checks and not be ejected.
+func (in *instance) available(now time.Time) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.health.healthy && !now.Before(in.ejectedUntil)
+}
+
+// pool spreads requests across the instances of one upstream.
+type pool struct {
+	name       string
+	service    string // registry name
+	strategy   string
+	instances  []*instance
+	ejectAfter int
+	ejectFor   time.Duration
+	checker    *checker
+	breaker    *breaker
+	budget     *retryBudget
+	required   bool
+
+	mu     sync.Mutex
+	next   int   // round-robin cursor
+	credit []int // smooth weighted round-robin state, per instance
+}
+
+// serviceName is the label used for the upstream in logs and errors.
+func (p *pool) serviceName() string {
+	return strings.ToUpper(p.name)
+}
+
+// urls lists the addresses of the pool's instances.
+func (p *pool) urls() []string {
+	urls := make([]string, 0, len(p.instances))
+	for _, in := range p.instances {
+		urls = append(urls, in.url.String())
+	}
+	return urls
+}
+
+// newPool builds the pool for an upstream. Instances that also existed in
+// prev (same URL) are reused, so their connection counts, ejection and health
+// state survive a configuration reload; so do the circuit breaker and the
+// retry budget.
+func newPool(name string, cfg UpstreamConfig, prev *pool) *pool {
+	p := &pool{
+		name:       name,
+		service:    cfg.serviceName(name),
+		strategy:   cfg.Strategy,
+		ejectAfter: cfg.Ejection.ConsecutiveErrors,
+		ejectFor:   time.Duration(cfg.Ejection.Duration),
+		checker:    newChecker(cfg.HealthCheck),
+		required:   cfg.Required,
+	}
+	if p.strategy == "" {
+		p.strategy = strategyRoundRobin
+	}
+	if p.ejectAfter == 0 {
+		p.ejectAfter = defaultEjectAfter
+	}
+	if p.ejectFor == 0 {
+		p.ejectFor = defaultEjectFor
+	}
+
+	existing := map[string]*instance{}
+	if prev != nil {
+		for _, in := range prev.instances {
+			existing[in.url.String()] = in
+		}
+		p.breaker, p.budget = prev.breaker, prev.budget
+	} else {
+		p.breaker, p.budget = newBreaker(name), newRetryBudget()
+	}
+	p.breaker.configure(cfg.CircuitBreaker)
+	p.budget.configure(cfg.RetryBudget)
+
+	for _, ic := range cfg.instances() {
+		u, _ := parseUpstreamURL(ic.URL)
+		weight := ic.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		in := existing[u.String()]
+		if in == nil {
+			in = &instance{url: u, health: healthState{healthy: true}}
+		}
+		in.mu.Lock()
+		in.weight = weight
+		if p.checker == nil {
+			// Without active checks only passive ejection applies.
+			in.health = healthState{healthy: true}
+		}
+		in.mu.Unlock()
+		p.instances = append(p.instances, in)
+	}
+	p.credit = make([]int, len(p.instances))
+	return p
+}
+
+// pick chooses the instance for the next request and marks it active. The
+// caller must call done once the request is over.
+func (p *pool) pick() (*instance, error) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var chosen *instance
+	switch p.strategy {
+	case strategyLeastConnections:
+		chosen = p.pickLeastConnections(now)
+	case strategyWeighted:
+		chosen = p.pickWeighted(now)
+	default:
+		chosen = p.pickRoundRobin(now)
+	}
+	if chosen == nil {
+		return nil, errNoInstance
+	}
+	chosen.active.Add(1)
+	return chosen, nil
+}
+
+// pickRoundRobin returns the next available instance after the cursor.
+// Callers must hold p.mu.
+func (p *pool) pickRoundRobin(now time.Time) *instance {
+	for i := range p.instances {
+		in := p.instances[(p.next+i)%len(p.instances)]
+		if in.available(now) {
+			p.next = (p.next + i + 1) % len(p.instances)
+			return in
+		}
+	}
+	return nil
+}
+
+// pickLeastConnections returns the available instance with the fewest active
+// requests; ties go to the first one after the round-robin cursor.
+// Callers must hold p.mu.
+func (p *pool) pickLeastConnections(now time.Time) *instance {
+	var best *instance
+	bestIndex := 0
+	for i := range p.instances {
+		idx := (p.next + i) % len(p.instances)
+		in := p.instances[idx]
+		if !in.available(now) {
+			continue
+		}
+		if best == nil || in.active.Load() < best.active.Load() {
+			best, bestIndex = in, idx
+		}
+	}
+	if best != nil {
+		p.next = (bestIndex + 1) % len(p.instances)
+	}
+	return best
+}
+
+// pickWeighted implements smooth weighted round-robin: every available
+// instance earns its weight in credit, the richest one is chosen and pays
+// back the total. Over time each instance gets a share of requests
+// proportional to its weight, without long bursts to the heaviest one.
+// Callers must hold p.mu.
+func (p *pool) pickWeighted(now time.Time) *instance {
+	total, best := 0, -1
+	for i, in := range p.instances {
+		if !in.available(now) {
+			continue
+		}
+		p.credit[i] += in.weight
+		total += in.weight
+		if best < 0 || p.credit[i] > p.credit[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	p.credit[best] -= total
+	return p.instances[best]
+}
+
+// done releases an instance picked by pick. err is the transport error of
+// the request, if any: consecutive connection errors eject the instance for
+// a while, any response brings the count back to zero.
+func (p *pool) done(in *instance, err error) {
+	in.active.Add(-1)
+
+	// A caller giving up is not the instance's fault.
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if err == nil {
+		in.consecutiveErrors = 0
+		return
+	}
+	in.consecutiveErrors++
+	if in.consecutiveErrors >= p.ejectAfter {
+		in.consecutiveErrors = 0
+		in.ejectedUntil = time.Now().Add(p.ejectFor)
+		slog.Warn("ejecting instance after connection errors",
+			"upstream", p.name, "instance", in.url.String(), "for", p.ejectFor.String(), "errors", p.ejectAfter)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Circuit breaker defaults, used when the upstream does not set them.
+const (
+	defaultFailureThreshold = 5
+	defaultCoolDown         = 30 * time.Second
+	defaultHalfOpenRequests = 1
+)
+
+// Breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// outcome is what an admitted request tells its breaker when it is done.
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeAbandoned frees the request's place without counting it either
+	// way: it says nothing about the upstream, e.g. because the caller gave
+	// up first.
+	outcomeAbandoned
+)
+
+// breaker is the circuit breaker of one upstream. While closed every request
+// goes through; failureThreshold failures in a row open it, and for coolDown
+// every request is rejected at once. After that the breaker is half-open and
+// lets halfOpenRequests trial requests through: a success closes it again,
+// a failure opens it for another coolDown.
+type breaker struct {
+	name string
+
+	mu               sync.Mutex
+	failureThreshold int
+	coolDown         time.Duration
+	halfOpenRequests int
+
+	state    string
+	failures int
+	openedAt time.Time
+	inTrial  int
+	// trials counts the half-open phases, so a trial that outlives its
+	// phase does not count in the next one.
+	trials int
+}
+
+func newBreaker(name string) *breaker {
+	return &breaker{name: name, state: breakerClosed}
+}
+
+// configure applies cfg, filling in the defaults. The current state is kept.
+func (b *breaker) configure(cfg CircuitBreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failureThreshold = cfg.FailureThreshold
+	if b.failureThreshold == 0 {
+		b.failureThreshold = defaultFailureThreshold
+	}
+	b.coolDown = time.Duration(cfg.CoolDown)
+	if b.coolDown == 0 {
+		b.coolDown = defaultCoolDown
+	}
+	b.halfOpenRequests = cfg.HalfOpenRequests
+	if b.halfOpenRequests == 0 {
+		b.halfOpenRequests = defaultHalfOpenRequests
+	}
+}
+
+// allow asks to send one request. When it is admitted, done must be called
+// with its outcome; otherwise errBreakerOpen is returned along with how long
+// the caller should wait before retrying.
+func (b *breaker) allow() (done func(outcome), retryAfter time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if wait := b.coolDown - time.Since(b.openedAt); wait > 0 {
+			return nil, wait, errBreakerOpen
+		}
+		b.state, b.inTrial = breakerHalfOpen, 0
+		b.trials++
+		slog.Info("circuit breaker half-open, sending trial requests", "upstream", b.name)
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.inTrial >= b.halfOpenRequests {
+			return nil, time.Second, errBreakerOpen
+		}
+		b.inTrial++
+		phase := b.trials
+		return func(o outcome) { b.trialDone(phase, o) }, 0, nil
+	}
+	return b.closedDone, 0, nil
+}
+
+// closedDone records the outcome of a request admitted while closed.
+func (b *breaker) closedDone(o outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed || o == outcomeAbandoned {
+		return
+	}
+	if o == outcomeSuccess {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.failureThreshold {
+		b.trip()
+	}
+}
+
+// trialDone records the outcome of a trial request admitted in the given
+// half-open phase. Once that phase is over the outcome is stale and ignored.
+func (b *breaker) trialDone(phase int, o outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if phase != b.trials {
+		return
+	}
+	b.inTrial--
+	if b.state != breakerHalfOpen || o == outcomeAbandoned {
+		return
+	}
+	if o == outcomeSuccess {
+		b.state, b.failures = breakerClosed, 0
+		slog.Info("circuit breaker closed", "upstream", b.name)
+		return
+	}
+	b.trip()
+}
+
+// trip opens the breaker. Callers must hold b.mu.
+func (b *breaker) trip() {
+	b.state, b.openedAt, b.failures = breakerOpen, time.Now(), 0
+	slog.Warn("circuit breaker open", "upstream", b.name, "cool_down", b.coolDown.String())
+}
+
+// isFailure decides whether a request outcome counts against the breaker:
+// transport errors, timeouts and 5xx answers do, a caller that gave up does
+// not.
+func isFailure(status int, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	return status >= http.StatusInternalServerError
+}
+
+// requestOutcome is the outcome of a request for the breaker. A caller that
+// gave up abandons the request, so a half-open breaker sends another trial
+// instead of closing on an answer it never saw.
+func requestOutcome(status int, err error) outcome {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return outcomeAbandoned
+	case isFailure(status, err):
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// breakerStatus is the /health view of a breaker.
+type breakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	FailureThreshold    int        `json:"failure_threshold"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryInSeconds      float64    `json:"retry_in_seconds,omitempty"`
+}
+
+func (b *breaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := breakerStatus{State: b.state, ConsecutiveFailures: b.failures, FailureThreshold: b.failureThreshold}
+	if b.state != breakerClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	if b.state == breakerOpen {
+		if wait := b.coolDown - time.Since(b.openedAt); wait > 0 {
+			s.RetryInSeconds = wait.Round(time.Millisecond).Seconds()
+		}
+	}
+	return s
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newTestBreaker returns a closed breaker opening after threshold failures
+// and admitting halfOpen trials.
+func newTestBreaker(threshold, halfOpen int) *breaker {
+	b := newBreaker("test")
+	b.configure(CircuitBreakerConfig{FailureThreshold: threshold, CoolDown: Duration(time.Minute), HalfOpenRequests: halfOpen})
+	return b
+}
+
+// coolDown makes the open breaker b's cool-down elapse.
+func coolDown(b *breaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openedAt = time.Now().Add(-b.coolDown)
+}
+
+// send admits one request and reports outcome o for it, failing the test
+// when the breaker rejects it.
+func send(t *testing.T, b *breaker, o outcome) {
+	t.Helper()
+	done, _, err := b.allow()
+	if err != nil {
+		t.Fatalf("request rejected in state %s: %v", b.status().State, err)
+	}
+	done(o)
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, b *breaker)
+		want string
+	}{
+		{
+			name: "failures below the threshold keep it closed",
+			run: func(t *testing.T, b *breaker) {
+				send(t, b, outcomeFailure)
+				send(t, b, outcomeFailure)
+			},
+			want: breakerClosed,
+		},
+		{
+			name: "a success resets the failure count",
+			run: func(t *testing.T, b *breaker) {
+				send(t, b, outcomeFailure)
+				send(t, b, outcomeFailure)
+				send(t, b, outcomeSuccess)
+				send(t, b, outcomeFailure)
+			},
+			want: breakerClosed,
+		},
+		{
+			name: "abandoned requests do not count",
+			run: func(t *testing.T, b *breaker) {
+				for range 5 {
+					send(t, b, outcomeAbandoned)
+				}
+			},
+			want: breakerClosed,
+		},
+		{
+			name: "the threshold opens it",
+			run: func(t *testing.T, b *breaker) {
+				for range 3 {
+					send(t, b, outcomeFailure)
+				}
+			},
+			want: breakerOpen,
+		},
+		{
+			name: "a successful trial closes it",
+			run: func(t *testing.T, b *breaker) {
+				for range 3 {
+					send(t, b, outcomeFailure)
+				}
+				coolDown(b)
+				send(t, b, outcomeSuccess)
+			},
+			want: breakerClosed,
+		},
+		{
+			name: "a failed trial opens it again",
+			run: func(t *testing.T, b *breaker) {
+				for range 3 {
+					send(t, b, outcomeFailure)
+				}
+				coolDown(b)
+				send(t, b, outcomeFailure)
+			},
+			want: breakerOpen,
+		},
+		{
+			name: "an abandoned trial leaves it half-open",
+			run: func(t *testing.T, b *breaker) {
+				for range 3 {
+					send(t, b, outcomeFailure)
+				}
+				coolDown(b)
+				send(t, b, outcomeAbandoned)
+			},
+			want: breakerHalfOpen,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBreaker(3, 1)
+			tt.run(t, b)
+			if got := b.status().State; got != tt.want {
+				t.Errorf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerOpenRejects(t *testing.T) {
+	b := newTestBreaker(1, 1)
+	send(t, b, outcomeFailure)
+	_, retryAfter, err := b.allow()
+	if !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("allow() error = %v, want errBreakerOpen", err)
+	}
+	if retryAfter <= 0 || retryAfter > time.Minute {
+		t.Errorf("retryAfter = %v, want within the cool-down", retryAfter)
+	}
+}
+
+func TestBreakerHalfOpenAdmitsLimitedTrials(t *testing.T) {
+	b := newTestBreaker(1, 2)
+	send(t, b, outcomeFailure)
+	coolDown(b)
+	for i := range 2 {
+		if _, _, err := b.allow(); err != nil {
+			t.Fatalf("trial %d rejected: %v", i+1, err)
+		}
+	}
+	if _, _, err := b.allow(); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("third trial: error = %v, want errBreakerOpen", err)
+	}
+}
+
+// A trial still running when its half-open phase ends must not free a place
+// in the next phase, or more trials than allowed would be admitted.
+func TestBreakerLateTrialIgnored(t *testing.T) {
+	b := newTestBreaker(1, 2)
+	send(t, b, outcomeFailure)
+	coolDown(b)
+
+	slow, _, err := b.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, b, outcomeFailure) // the other trial fails: open again
+	coolDown(b)
+
+	// Fill the new phase, then let the slow trial of the old one finish.
+	for i := range 2 {
+		if _, _, err := b.allow(); err != nil {
+			t.Fatalf("trial %d of the new phase rejected: %v", i+1, err)
+		}
+	}
+	slow(outcomeSuccess)
+
+	if got := b.status().State; got != breakerHalfOpen {
+		t.Errorf("state = %s, want %s", got, breakerHalfOpen)
+	}
+	if _, _, err := b.allow(); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("extra trial: error = %v, want errBreakerOpen", err)
+	}
+}
+
+func TestRequestOutcome(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+		want   outcome
+	}{
+		{http.StatusOK, nil, outcomeSuccess},
+		{http.StatusNotFound, nil, outcomeSuccess},
+		{http.StatusBadGateway, nil, outcomeFailure},
+		{0, errors.New("connection refused"), outcomeFailure},
+		{0, context.DeadlineExceeded, outcomeFailure},
+		{0, context.Canceled, outcomeAbandoned},
+	}
+	for _, tt := range tests {
+		if got := requestOutcome(tt.status, tt.err); got != tt.want {
+			t.Errorf("requestOutcome(%d, %v) = %d, want %d", tt.status, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response cache defaults, used when the configuration does not set them.
+const (
+	defaultCacheEntries   = 1000
+	defaultCacheEntrySize = 1 << 20
+)
+
+// Values of the X-Cache header telling how a response was served.
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+	cacheBypass      = "BYPASS"
+)
+
+// cacheEntry is a stored GET response. The cache hands out copies: the
+// entries it holds change only under its lock.
+type cacheEntry struct {
+	key      string
+	upstream string
+	status   int
+	header   http.Header
+	body     []byte
+	etag     string
+	stored   time.Time
+	expires  time.Time
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool { return now.Before(e.expires) }
+
+// clone copies e along with its header. The body is never modified once
+// stored, so the copies share it.
+func (e *cacheEntry) clone() *cacheEntry {
+	c := *e
+	c.header = e.header.Clone()
+	return &c
+}
+
+// responseCache is an LRU cache of GET responses shared by the cached
+// routes.
+type responseCache struct {
+	mu           sync.Mutex
+	maxEntries   int
+	maxEntrySize int
+	lru          *list.List // of *cacheEntry, most recently used first
+	entries      map[string]*list.Element
+	stats        cacheStats
+}
+
+// cacheStats counts what the cache did since the gateway started.
+type cacheStats struct {
+	Entries       int   `json:"entries"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Revalidations int64 `json:"revalidations"`
+	Stores        int64 `json:"stores"`
+	Evictions     int64 `json:"evictions"`
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// configure applies the limits of cfg, evicting entries over the new size.
+func (c *responseCache) configure(cfg CacheConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = cmp.Or(cfg.MaxEntries, defaultCacheEntries)
+	c.maxEntrySize = cmp.Or(cfg.MaxEntrySize, defaultCacheEntrySize)
+	c.evict()
+}
+
+// get returns a copy of the entry stored under key, or nil.
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).clone()
+}
+
+// put stores a copy of e, replacing any entry under the same key.
+func (c *responseCache) put(e *cacheEntry) {
+	stored := e.clone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(stored)
+	c.stats.Stores++
+	c.evict()
+}
+
+// refresh extends the life of e, which the upstream has confirmed, and
+// returns the refreshed copy. The stored entry is refreshed too unless it
+// was replaced by another response meanwhile.
+func (c *responseCache) refresh(e *cacheEntry, now, expires time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		if stored := el.Value.(*cacheEntry); stored.etag == e.etag {
+			stored.stored, stored.expires = now, expires
+		}
+	}
+	c.stats.Revalidations++
+	refreshed := e.clone()
+	refreshed.stored, refreshed.expires = now, expires
+	return refreshed
+}
+
+// invalidate drops every response from upstream.
+func (c *responseCache) invalidate(upstream string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.entries {
+		if el.Value.(*cacheEntry).upstream == upstream {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// evict drops the least recently used entries over maxEntries. c.mu must be
+// held.
+func (c *responseCache) evict() {
+	for c.lru.Len() > c.maxEntries {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *responseCache) count(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
+
+func (c *responseCache) snapshot() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.lru.Len()
+	return s
+}
+
+// cacheKey identifies the response to r: the same URL fetched by two
+// callers is stored twice, so no one is served data fetched for someone
+// else.
+func cacheKey(r *http.Request) string {
+	subject := ""
+	if id := identityFrom(r.Context()); id != nil {
+		subject = id.Subject
+	}
+	return r.URL.RequestURI() + "\x00" + subject
+}
+
+// serveCached answers a GET or HEAD request on a cached route: from the
+// cache when it holds a fresh response, otherwise from the upstream,
+// revalidating a stale response with If-None-Match when it has an ETag.
+func (t *routeTable) serveCached(w http.ResponseWriter, r *http.Request, rt *route) {
+	c := t.cache
+	key := cacheKey(r)
+	now := time.Now()
+
+	var e *cacheEntry
+	if !requestsNoCache(r.Header) {
+		e = c.get(key)
+	}
+	if e != nil && e.fresh(now) {
+		c.count(true)
+		writeCached(w, r, e, cacheHit, now)
+		return
+	}
+	c.count(false)
+	if r.Method == http.MethodHead && e == nil {
+		w.Header().Set("X-Cache", cacheMiss)
+		forwardRequest(w, r, rt)
+		return
+	}
+
+	// The caller's own conditional headers are answered from the entry;
+	// the upstream is asked for the full response or to confirm ours.
+	out := r.Clone(r.Context())
+	out.Method = http.MethodGet
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	if e != nil && e.etag != "" {
+		out.Header.Set("If-None-Match", e.etag)
+	}
+	rec := &cacheRecorder{w: w, header: http.Header{}, limit: c.maxEntrySize}
+	forwardRequest(rec, out, rt)
+	if rec.streaming {
+		return
+	}
+
+	if rec.status == 0 {
+		// Nothing was answered: the caller went away.
+		return
+	}
+	now = time.Now()
+	ttl, storable := freshness(rec.header, time.Duration(rt.Cache.TTL))
+	switch {
+	case e != nil && rec.status == http.StatusNotModified:
+		writeCached(w, r, c.refresh(e, now, now.Add(ttl)), cacheRevalidated, now)
+	case rec.status == http.StatusOK && storable:
+		e = &cacheEntry{
+			key:      key,
+			upstream: rt.Upstream,
+			status:   rec.status,
+			header:   rec.header,
+			body:     rec.body.Bytes(),
+			etag:     rec.header.Get("ETag"),
+			stored:   now,
+			expires:  now.Add(ttl),
+		}
+		c.put(e)
+		writeCached(w, r, e, cacheMiss, now)
+	default:
+		rec.header.Set("X-Cache", cacheBypass)
+		rec.flush()
+	}
+}
+
+// requestsNoCache reports whether the caller asked for a response straight
+// from the upstream.
+func requestsNoCache(h http.Header) bool {
+	cc := strings.ToLower(strings.Join(h.Values("Cache-Control"), ","))
+	return strings.Contains(cc, "no-cache") || strings.Contains(cc, "no-store") ||
+		(cc == "" && strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache"))
+}
+
+// freshness reads how long a response with header h may be served from the
+// cache, at most ttl. storable is false when the upstream forbids shared
+// caching, sets a cookie or varies the response on request headers. A
+// no-cache response is stored only if it has an ETag to revalidate with.
+func freshness(h http.Header, ttl time.Duration) (_ time.Duration, storable bool) {
+	if h.Get("Set-Cookie") != "" || h.Get("Vary") != "" {
+		return 0, false
+	}
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(strings.Join(h.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		switch name {
+		case "no-store", "private":
+			return 0, false
+		case "no-cache":
+			return 0, h.Get("ETag") != ""
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sMaxAge = parseSeconds(value)
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge >= 0 {
+		ttl = min(ttl, time.Duration(maxAge)*time.Second)
+	}
+	return ttl, true
+}
+
+func parseSeconds(s string) int {
+	n, err := strconv.Atoi(strings.Trim(s, `"`))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// writeCached answers r with e, or with 304 when the caller already holds
+// it.
+func writeCached(w http.ResponseWriter, r *http.Request, e *cacheEntry, how string, now time.Time) {
+	h := w.Header()
+	for key, values := range e.header {
+		h[key] = slices.Clone(values)
+	}
+	h.Set("X-Cache", how)
+	h.Set("Age", strconv.Itoa(int(now.Sub(e.stored).Seconds())))
+	if e.etag != "" && etagMatches(r.Header.Get("If-None-Match"), e.etag) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// etagMatches applies the weak comparison of If-None-Match (RFC 9110,
+// section 13.1.2) between the header value list and etag.
+func etagMatches(list, etag string) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder holds an upstream response in memory so it can be stored.
+// A body larger than limit is not cached: the recorder then writes what it
+// holds to w and streams the rest.
+type cacheRecorder struct {
+	w         http.ResponseWriter
+	header    http.Header
+	status    int
+	body      bytes.Buffer
+	limit     int
+	streaming bool
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	if rec.streaming {
+		return rec.w.Header()
+	}
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.streaming {
+		return rec.w.Write(p)
+	}
+	if rec.body.Len()+len(p) <= rec.limit {
+		return rec.body.Write(p)
+	}
+	rec.header.Set("X-Cache", cacheBypass)
+	rec.flush()
+	rec.streaming = true
+	return rec.w.Write(p)
+}
+
+func (rec *cacheRecorder) Flush() {
+	if f, ok := rec.w.(http.Flusher); ok && rec.streaming {
+		f.Flush()
+	}
+}
+
+// flush writes the recorded response to w.
+func (rec *cacheRecorder) flush() {
+	for key, values := range rec.header {
+		rec.w.Header()[key] = values
+	}
+	rec.w.WriteHeader(rec.status)
+	rec.w.Write(rec.body.Bytes())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	const ttl = time.Minute
+	tests := []struct {
+		name         string
+		header       http.Header
+		want         time.Duration
+		wantStorable bool
+	}{
+		{"no directives", http.Header{}, ttl, true},
+		{"shorter max-age", http.Header{"Cache-Control": {"max-age=10"}}, 10 * time.Second, true},
+		{"longer max-age", http.Header{"Cache-Control": {"max-age=3600"}}, ttl, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=30, s-maxage=5"}}, 5 * time.Second, true},
+		{"directives over several fields", http.Header{"Cache-Control": {"public", "Max-Age=20"}}, 20 * time.Second, true},
+		{"max-age zero", http.Header{"Cache-Control": {"max-age=0"}}, 0, true},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{"no-cache without etag", http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{"no-cache with etag", http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"1"`}}, 0, true},
+		{"set-cookie", http.Header{"Set-Cookie": {"a=b"}}, 0, false},
+		{"vary", http.Header{"Vary": {"Accept-Language"}}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, storable := freshness(tt.header, ttl)
+			if got != tt.want || storable != tt.wantStorable {
+				t.Errorf("freshness() = %v, %v; want %v, %v", got, storable, tt.want, tt.wantStorable)
+			}
+		})
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		list, etag string
+		want       bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`"a"`, `"b"`, false},
+		{`"b", "a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`*`, `"a"`, true},
+		{` * `, `"a"`, true},
+		{``, `"a"`, false},
+		{`"ab"`, `"a"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.list, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.list, tt.etag, got, tt.want)
+		}
+	}
+}
+
+// The entries handed out by the cache must not share their header with
+// the stored entry.
+func TestCacheEntriesAreCopies(t *testing.T) {
+	c := newResponseCache()
+	c.configure(CacheConfig{})
+	e := &cacheEntry{key: "k", status: http.StatusOK, header: http.Header{"X-A": {"1"}}, etag: `"1"`}
+	c.put(e)
+	e.header.Set("X-A", "changed by the caller of put")
+
+	got := c.get("k")
+	if got == nil {
+		t.Fatal("entry not found")
+	}
+	got.header.Set("X-A", "changed by the caller of get")
+	if v := c.get("k").header.Get("X-A"); v != "1" {
+		t.Errorf("stored header X-A = %q, want %q", v, "1")
+	}
+}
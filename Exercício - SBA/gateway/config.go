@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written in the config as a string like "5s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Config is the gateway configuration file.
+type Config struct {
+	Upstreams map[string]UpstreamConfig `json:"upstreams"`
+	Routes    []RouteConfig             `json:"routes"`
+	// Auth turns on bearer token authentication; without it every route
+	// is public.
+	Auth *AuthConfig `json:"auth,omitempty"`
+	// RateLimitStore is a directory holding the rate limit buckets, shared
+	// by every gateway instance that must enforce common limits. Without
+	// it each instance keeps its own buckets in memory.
+	RateLimitStore string `json:"rate_limit_store,omitempty"`
+	// Cache sizes the response cache used by routes with a cache section.
+	Cache CacheConfig `json:"cache"`
+	// Registry resolves the upstream instances from a service registry,
+	// falling back to the instances listed here for the upstreams it has
+	// none of.
+	Registry *RegistryConfig `json:"registry,omitempty"`
+	// Profile sets who may use /api/profile and how often.
+	Profile ProfileConfig `json:"profile"`
+}
+
+// ProfileConfig holds the access rules and rate limit of /api/profile,
+// applied as they are on a route.
+type ProfileConfig struct {
+	Access    AccessConfig     `json:"access"`
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+}
+
+// RegistryConfig points the gateway at a service registry. URL defaults to
+// the -registry flag (REGISTRY_URL); with neither set the registry is not
+// used. The instances are fetched every RefreshInterval (5s by default).
+type RegistryConfig struct {
+	URL             string   `json:"url,omitempty"`
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+}
+
+// CacheConfig bounds the response cache: at most MaxEntries responses (1000
+// by default) of at most MaxEntrySize bytes each (1 MiB by default).
+type CacheConfig struct {
+	MaxEntries   int `json:"max_entries,omitempty"`
+	MaxEntrySize int `json:"max_entry_size,omitempty"`
+}
+
+// AuthConfig sets how the JWTs sent by callers are verified. HS256 tokens
+// are checked with the secret held in the environment variable SecretEnv,
+// RS256 tokens with the public keys of the JWK Set in JWKSFile; at least one
+// must be set. Issuer and Audience, when set, must match the iss and aud
+// claims, and Leeway allows for clock skew when checking exp and nbf.
+// RateLimit caps how often one IP address may present credentials, before
+// they are checked, so that tokens and API keys cannot be guessed at full
+// speed; its per setting is ignored. It defaults to defaultAuthRateLimit.
+type AuthConfig struct {
+	SecretEnv string           `json:"secret_env,omitempty"`
+	JWKSFile  string           `json:"jwks_file,omitempty"`
+	Issuer    string           `json:"issuer,omitempty"`
+	Audience  string           `json:"audience,omitempty"`
+	Leeway    Duration         `json:"leeway,omitempty"`
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+}
+
+// UpstreamConfig describes a service the gateway forwards to.
+type UpstreamConfig struct {
+	// URL is a shorthand for a single instance.
+	URL string `json:"url,omitempty"`
+	// Instances lists the servers requests are balanced across. With a
+	// registry they are only used while it lists no instance of Service.
+	Instances []InstanceConfig `json:"instances,omitempty"`
+	// Service is the name the upstream's instances register under; it
+	// defaults to the upstream's own name.
+	Service string `json:"service,omitempty"`
+	// Strategy is round_robin (the default), least_connections or weighted.
+	Strategy string `json:"strategy,omitempty"`
+	// Ejection controls how instances with connection errors are taken out
+	// of rotation.
+	Ejection EjectionConfig `json:"ejection"`
+	// HealthCheck configures active probing of every instance.
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	// CircuitBreaker stops calls to the upstream while it keeps failing.
+	CircuitBreaker CircuitBreakerConfig `json:"circuit_breaker"`
+	// RetryBudget limits how many retries the routes may send to the
+	// upstream.
+	RetryBudget RetryBudgetConfig `json:"retry_budget"`
+	// Required makes the gateway report itself unhealthy (503 on /health)
+	// while no instance of this upstream is available.
+	Required bool `json:"required,omitempty"`
+}
+
+// InstanceConfig is one server of an upstream.
+type InstanceConfig struct {
+	URL string `json:"url"`
+	// Weight is only used by the weighted strategy; it defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+// EjectionConfig sets passive ejection: after ConsecutiveErrors connection
+// errors in a row an instance receives no traffic for Duration.
+type EjectionConfig struct {
+	ConsecutiveErrors int      `json:"consecutive_errors,omitempty"`
+	Duration          Duration `json:"duration,omitempty"`
+}
+
+// HealthCheckConfig sets active health checks: Path is requested on every
+// instance each Interval; UnhealthyThreshold failures in a row take the
+// instance out of rotation and HealthyThreshold successes bring it back. An
+// empty Path disables the checks.
+type HealthCheckConfig struct {
+	Path               string   `json:"path,omitempty"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`
+}
+
+// CircuitBreakerConfig sets the upstream's circuit breaker: it opens after
+// FailureThreshold failed requests in a row, rejects requests for CoolDown
+// and then lets HalfOpenRequests trial requests decide whether to close.
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold,omitempty"`
+	CoolDown         Duration `json:"cool_down,omitempty"`
+	HalfOpenRequests int      `json:"half_open_requests,omitempty"`
+}
+
+// RetryBudgetConfig caps retries to an upstream: over the last ten seconds
+// they may add up to Ratio of the requests sent to it (0.2 by default), with
+// MinRetriesPerSecond always allowed (2 by default) so that retries still
+// work under low traffic.
+type RetryBudgetConfig struct {
+	Ratio               float64 `json:"ratio,omitempty"`
+	MinRetriesPerSecond float64 `json:"min_retries_per_second,omitempty"`
+}
+
+// serviceName is the name the upstream called name is registered under.
+func (u UpstreamConfig) serviceName(name string) string {
+	return cmp.Or(u.Service, name)
+}
+
+// instances returns the configured instances, expanding the URL shorthand.
+func (u UpstreamConfig) instances() []InstanceConfig {
+	if u.URL != "" {
+		return []InstanceConfig{{URL: u.URL}}
+	}
+	return u.Instances
+}
+
+// RouteConfig maps a path prefix to an upstream.
+type RouteConfig struct {
+	// Prefix selects the requests handled by the route; the longest
+	// matching prefix wins.
+	Prefix string `json:"prefix"`
+	// StripPrefix is removed from the path before forwarding.
+	StripPrefix string `json:"strip_prefix"`
+	// Upstream names an entry of Config.Upstreams.
+	Upstream string `json:"upstream"`
+	// Methods lists the allowed HTTP methods; empty allows all of them.
+	Methods []string `json:"methods"`
+	// Timeout bounds the whole upstream call, retries included; zero means
+	// no limit.
+	Timeout Duration `json:"timeout"`
+	// ConnectTimeout bounds establishing a connection to an instance.
+	ConnectTimeout Duration `json:"connect_timeout,omitempty"`
+	// ResponseTimeout bounds the wait for the response headers of one
+	// attempt once the request has been sent.
+	ResponseTimeout Duration `json:"response_timeout,omitempty"`
+	// Retry repeats failed idempotent requests.
+	Retry RetryConfig `json:"retry"`
+	// Public routes are served without authentication.
+	Public bool `json:"public,omitempty"`
+	// Access restricts the route to callers holding some roles.
+	Access AccessConfig `json:"access"`
+	// RateLimit caps how often callers may use the route.
+	RateLimit *RateLimitConfig `json:"rate_limit,omitempty"`
+	// Cache stores the route's GET responses.
+	Cache *RouteCacheConfig `json:"cache,omitempty"`
+}
+
+// RouteCacheConfig keeps a route's successful GET responses for up to TTL,
+// less when the upstream's Cache-Control says so. Responses are cached per
+// caller, and any other method sent through the gateway to the same upstream
+// drops its cached responses.
+type RouteCacheConfig struct {
+	TTL Duration `json:"ttl"`
+}
+
+// RateLimitConfig is a token bucket: a caller may send Burst requests at
+// once, and the bucket refills at Rate requests per second. Per chooses
+// whose requests share a bucket: "client" (the default) counts each
+// authenticated user or API key on its own and anonymous callers by IP
+// address, "ip" always counts by IP address and "route" puts every caller
+// of the route in the same bucket.
+type RateLimitConfig struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	Per   string  `json:"per,omitempty"`
+}
+
+// AccessConfig lists the roles allowed on a route: Read applies to GET, HEAD
+// and OPTIONS requests, Write to every other method. An empty list lets any
+// authenticated caller through; the services still check that callers only
+// touch their own data.
+type AccessConfig struct {
+	Read  []string `json:"read,omitempty"`
+	Write []string `json:"write,omitempty"`
+}
+
+// RetryConfig sets how failed requests are retried. Only idempotent methods
+// (GET, HEAD, OPTIONS, PUT, DELETE) are retried, after connection errors,
+// timeouts of one attempt and 502, 503 or 504 answers. The wait before retry
+// n is BaseDelay*2^(n-1), capped at MaxDelay, with random jitter.
+type RetryConfig struct {
+	// MaxRetries is the number of retries after the first attempt; zero
+	// disables retries.
+	MaxRetries int      `json:"max_retries,omitempty"`
+	BaseDelay  Duration `json:"base_delay,omitempty"`
+	MaxDelay   Duration `json:"max_delay,omitempty"`
+}
+
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+	http.MethodOptions: true,
+}
+
+// loadConfig reads and validates the configuration file at path.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// validate reports every problem found in the configuration at once.
+func (c *Config) validate() error {
+	var errs []error
+
+	for name, up := range c.Upstreams {
+		if err := up.validate(c.Registry.address() != ""); err != nil {
+			errs = append(errs, fmt.Errorf("upstream %q: %w", name, err))
+		}
+	}
+
+	if len(c.Routes) == 0 {
+		errs = append(errs, errors.New("no routes defined"))
+	}
+	seen := map[string]bool{}
+	for i, rc := range c.Routes {
+		where := fmt.Sprintf("route %d (%s)", i, rc.Prefix)
+		if !strings.HasPrefix(rc.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("%s: prefix must start with /", where))
+		}
+		if seen[rc.Prefix] {
+			errs = append(errs, fmt.Errorf("%s: duplicate prefix", where))
+		}
+		seen[rc.Prefix] = true
+		if !strings.HasPrefix(rc.Prefix, rc.StripPrefix) {
+			errs = append(errs, fmt.Errorf("%s: strip_prefix %q is not a prefix of the route", where, rc.StripPrefix))
+		}
+		if _, ok := c.Upstreams[rc.Upstream]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown upstream %q", where, rc.Upstream))
+		}
+		for _, m := range rc.Methods {
+			if !knownMethods[m] {
+				errs = append(errs, fmt.Errorf("%s: unsupported method %q", where, m))
+			}
+		}
+		if rc.Timeout < 0 || rc.ConnectTimeout < 0 || rc.ResponseTimeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: timeouts must not be negative", where))
+		}
+		errs = append(errs, validateAccess(where, rc.Access, rc.RateLimit)...)
+		if rc.Cache != nil && rc.Cache.TTL <= 0 {
+			errs = append(errs, fmt.Errorf("%s: cache ttl must be positive", where))
+		}
+		if rc.Retry.MaxRetries < 0 || rc.Retry.BaseDelay < 0 || rc.Retry.MaxDelay < 0 {
+			errs = append(errs, fmt.Errorf("%s: retry settings must not be negative", where))
+		}
+		if rc.Retry.MaxDelay > 0 && rc.Retry.BaseDelay > rc.Retry.MaxDelay {
+			errs = append(errs, fmt.Errorf("%s: retry base_delay is larger than max_delay", where))
+		}
+	}
+
+	errs = append(errs, validateAccess("profile", c.Profile.Access, c.Profile.RateLimit)...)
+
+	if c.Cache.MaxEntries < 0 || c.Cache.MaxEntrySize < 0 {
+		errs = append(errs, errors.New("cache: settings must not be negative"))
+	}
+
+	if r := c.Registry; r != nil {
+		if r.URL != "" {
+			if _, err := parseUpstreamURL(r.URL); err != nil {
+				errs = append(errs, fmt.Errorf("registry: %w", err))
+			}
+		}
+		if r.RefreshInterval < 0 {
+			errs = append(errs, errors.New("registry: refresh_interval must not be negative"))
+		}
+	}
+
+	if c.Auth != nil {
+		if c.Auth.SecretEnv == "" && c.Auth.JWKSFile == "" {
+			errs = append(errs, errors.New("auth: set secret_env, jwks_file or both"))
+		}
+		if c.Auth.Leeway < 0 {
+			errs = append(errs, errors.New("auth: leeway must not be negative"))
+		}
+		errs = append(errs, validateRateLimit("auth", c.Auth.RateLimit)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateAccess checks the access rules and rate limit of a route, or of
+// the profile; where names it in the errors.
+func validateAccess(where string, access AccessConfig, rl *RateLimitConfig) []error {
+	var errs []error
+	for _, role := range append(slices.Clone(access.Read), access.Write...) {
+		if !slices.Contains(knownRoles, role) {
+			errs = append(errs, fmt.Errorf("%s: unknown role %q", where, role))
+		}
+	}
+	return append(errs, validateRateLimit(where, rl)...)
+}
+
+// validateRateLimit checks a rate limit, which may be nil; where names its
+// owner in the errors.
+func validateRateLimit(where string, rl *RateLimitConfig) []error {
+	var errs []error
+	if rl != nil {
+		if rl.Rate <= 0 || rl.Burst < 1 {
+			errs = append(errs, fmt.Errorf("%s: rate_limit needs a positive rate and a burst of at least 1", where))
+		}
+		switch rl.Per {
+		case "", rateLimitPerClient, rateLimitPerIP, rateLimitPerRoute:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown rate_limit per %q", where, rl.Per))
+		}
+	}
+	return errs
+}
+
+// validate checks the upstream's settings; discovered says whether its
+// instances may come from a registry instead.
+func (u UpstreamConfig) validate(discovered bool) error {
+	var errs []error
+	switch {
+	case u.URL != "" && len(u.Instances) > 0:
+		errs = append(errs, errors.New("set either url or instances, not both"))
+	case len(u.instances()) == 0 && !discovered:
+		errs = append(errs, errors.New("no instances defined"))
+	}
+	seen := map[string]bool{}
+	for _, ic := range u.instances() {
+		if _, err := parseUpstreamURL(ic.URL); err != nil {
+			errs = append(errs, err)
+		}
+		if seen[ic.URL] {
+			errs = append(errs, fmt.Errorf("instance %q listed twice", ic.URL))
+		}
+		seen[ic.URL] = true
+		if ic.Weight < 0 {
+			errs = append(errs, fmt.Errorf("instance %q: weight must not be negative", ic.URL))
+		}
+	}
+	switch u.Strategy {
+	case "", strategyRoundRobin, strategyLeastConnections, strategyWeighted:
+	default:
+		errs = append(errs, fmt.Errorf("unknown strategy %q", u.Strategy))
+	}
+	if u.Ejection.ConsecutiveErrors < 0 || u.Ejection.Duration < 0 {
+		errs = append(errs, errors.New("ejection settings must not be negative"))
+	}
+	hc := u.HealthCheck
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		errs = append(errs, errors.New("health_check path must start with /"))
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.UnhealthyThreshold < 0 || hc.HealthyThreshold < 0 {
+		errs = append(errs, errors.New("health_check settings must not be negative"))
+	}
+	cb := u.CircuitBreaker
+	if cb.FailureThreshold < 0 || cb.CoolDown < 0 || cb.HalfOpenRequests < 0 {
+		errs = append(errs, errors.New("circuit_breaker settings must not be negative"))
+	}
+	rb := u.RetryBudget
+	if rb.Ratio < 0 || rb.MinRetriesPerSecond < 0 {
+		errs = append(errs, errors.New("retry_budget settings must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// parseUpstreamURL checks that raw is an absolute http(s) URL.
+func parseUpstreamURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url %q must be an absolute http or https URL", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("url %q must not have a query or fragment", raw)
+	}
+	return u, nil
+}
+
+// route is a RouteConfig resolved against its upstream.
+type route struct {
+	RouteConfig
+	pool      *pool
+	methods   map[string]bool
+	transport http.RoundTripper
+	retry     retryPolicy
+}
+
+// serviceName is the label used for the route's upstream in logs and errors.
+func (rt *route) serviceName() string {
+	return rt.pool.serviceName()
+}
+
+// allows reports whether the route accepts method. HEAD is accepted
+// wherever GET is.
+func (rt *route) allows(method string) bool {
+	if len(rt.methods) == 0 {
+		return true
+	}
+	return rt.methods[method] || (method == http.MethodHead && rt.methods[http.MethodGet])
+}
+
+// targetURL is the URL on instance base for a request to u.
+func (rt *route) targetURL(base, u *url.URL) string {
+	target := *base
+	target.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(u.Path, rt.StripPrefix)
+	target.RawPath = ""
+	target.RawQuery = u.RawQuery
+	return target.String()
+}
+
+// routeTable is the validated set of routes, longest prefix first, with the
+// upstream pools they forward to.
+type routeTable struct {
+	routes []*route
+	pools  map[string]*pool
+	// verifier checks bearer tokens; nil when authentication is off.
+	verifier *tokenVerifier
+	// authLimit is the rate limit of each IP address presenting
+	// credentials.
+	authLimit RateLimitConfig
+	// limiter holds the rate limit buckets, in the directory storeDir or
+	// in memory when it is empty.
+	limiter  rateStore
+	storeDir string
+	// cache holds the responses of cached routes.
+	cache *responseCache
+	// transports holds one transport per distinct pair of route timeouts,
+	// so routes with the same settings share their connections.
+	transports map[[2]Duration]*http.Transport
+	// registry is where the upstream instances are discovered, nil when
+	// they all come from the configuration file.
+	registry *RegistryConfig
+	// profile carries the access rules and rate limit of /api/profile.
+	profile *route
+	// stopChecks ends the health checks started for this table.
+	stopChecks func()
+}
+
+// newRouteTable builds the table for cfg. Pools reuse the instances of prev
+// (which may be nil), the response cache is kept and so are the rate limit
+// buckets while their store does not change, so their state carries over a
+// reload.
+func newRouteTable(cfg *Config, prev *routeTable) (*routeTable, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	t := &routeTable{pools: map[string]*pool{}, transports: map[[2]Duration]*http.Transport{}, registry: cfg.Registry}
+	if cfg.Auth != nil {
+		v, err := newTokenVerifier(*cfg.Auth)
+		if err != nil {
+			return nil, err
+		}
+		t.verifier = v
+		t.authLimit = defaultAuthRateLimit
+		if cfg.Auth.RateLimit != nil {
+			t.authLimit = *cfg.Auth.RateLimit
+		}
+		t.authLimit.Per = rateLimitPerIP
+	}
+	t.storeDir = cfg.RateLimitStore
+	switch {
+	case prev != nil && prev.storeDir == t.storeDir:
+		t.limiter = prev.limiter
+	case t.storeDir == "":
+		t.limiter = newMemoryRateStore()
+	default:
+		store, err := newFileRateStore(t.storeDir)
+		if err != nil {
+			return nil, fmt.Errorf("rate_limit_store: %w", err)
+		}
+		t.limiter = store
+	}
+	if prev != nil {
+		t.cache = prev.cache
+	} else {
+		t.cache = newResponseCache()
+	}
+	t.cache.configure(cfg.Cache)
+	for name, up := range cfg.Upstreams {
+		var old *pool
+		if prev != nil {
+			old = prev.pools[name]
+		}
+		t.pools[name] = newPool(name, up, old)
+	}
+	for _, rc := range cfg.Routes {
+		rt := &route{
+			RouteConfig: rc,
+			pool:        t.pools[rc.Upstream],
+			methods:     map[string]bool{},
+			transport:   t.transport(rc.ConnectTimeout, rc.ResponseTimeout),
+			retry:       newRetryPolicy(rc.Retry),
+		}
+		for _, m := range rc.Methods {
+			rt.methods[m] = true
+		}
+		t.routes = append(t.routes, rt)
+	}
+	t.profile = &route{RouteConfig: RouteConfig{
+		Prefix:    profilePrefix,
+		Access:    cfg.Profile.Access,
+		RateLimit: cfg.Profile.RateLimit,
+	}}
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return len(t.routes[i].Prefix) > len(t.routes[j].Prefix)
+	})
+	return t, nil
+}
+
+// transport returns the table's transport for the given timeouts, creating
+// it on first use.
+func (t *routeTable) transport(connect, response Duration) *http.Transport {
+	key := [2]Duration{connect, response}
+	if tr, ok := t.transports[key]; ok {
+		return tr
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if connect > 0 {
+		dialer := &net.Dialer{Timeout: time.Duration(connect), KeepAlive: 30 * time.Second}
+		tr.DialContext = dialer.DialContext
+	}
+	tr.ResponseHeaderTimeout = time.Duration(response)
+	t.transports[key] = tr
+	return tr
+}
+
+// closeIdleConnections releases the pooled connections of a table that is
+// no longer in use.
+func (t *routeTable) closeIdleConnections() {
+	for _, tr := range t.transports {
+		tr.CloseIdleConnections()
+	}
+}
+
+// match returns the route for path, or nil when no route applies.
+func (t *routeTable) match(path string) *route {
+	for _, rt := range t.routes {
+		if strings.HasPrefix(path, rt.Prefix) {
+			return rt
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"platform/discovery"
+)
+
+// defaultRegistryRefresh is how often the registry is asked for instances
+// when the configuration does not say.
+const defaultRegistryRefresh = 5 * time.Second
+
+// registryURL is the registry given with -registry, used when the
+// configuration names none; main sets it.
+var registryURL string
+
+// discovered holds the instances last listed by the registry, by service
+// name; nil until the registry first answers. When the registry cannot be
+// reached they are kept, as the best knowledge there is.
+var discovered atomic.Pointer[map[string][]InstanceConfig]
+
+// address is the registry's base URL, or "" when none is configured.
+func (r *RegistryConfig) address() string {
+	if r == nil {
+		return ""
+	}
+	return strings.TrimSuffix(cmp.Or(r.URL, registryURL), "/")
+}
+
+// refreshInterval is how often the registry is polled.
+func (r *RegistryConfig) refreshInterval() time.Duration {
+	if r == nil || r.RefreshInterval == 0 {
+		return defaultRegistryRefresh
+	}
+	return time.Duration(r.RefreshInterval)
+}
+
+// applyDiscovered replaces the configured instances of every upstream the
+// registry lists instances of. The others keep the instances of the
+// configuration file.
+func applyDiscovered(cfg *Config) {
+	found := discovered.Load()
+	if found == nil || cfg.Registry.address() == "" {
+		return
+	}
+	for name, up := range cfg.Upstreams {
+		if instances := (*found)[up.serviceName(name)]; len(instances) > 0 {
+			up.URL, up.Instances = "", instances
+			cfg.Upstreams[name] = up
+		}
+	}
+}
+
+// registryInstance is the part of a registry entry the gateway uses.
+type registryInstance struct {
+	Address  string            `json:"address"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// fetchInstances lists the live instances of every service known to the
+// registry at base. The "weight" metadata of an instance sets its weight.
+func fetchInstances(base string) (map[string][]InstanceConfig, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, base+"/services", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := discovery.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry answered %s", resp.Status)
+	}
+	var listed map[string][]registryInstance
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		return nil, fmt.Errorf("decoding registry answer: %w", err)
+	}
+
+	found := map[string][]InstanceConfig{}
+	for service, entries := range listed {
+		var instances []InstanceConfig
+		for _, e := range entries {
+			if _, err := parseUpstreamURL(e.Address); err != nil {
+				continue
+			}
+			// Two registrations may announce the same address.
+			if slices.ContainsFunc(instances, func(ic InstanceConfig) bool { return ic.URL == e.Address }) {
+				continue
+			}
+			weight, _ := strconv.Atoi(e.Metadata["weight"])
+			instances = append(instances, InstanceConfig{URL: e.Address, Weight: max(weight, 0)})
+		}
+		if len(instances) > 0 {
+			slices.SortFunc(instances, func(a, b InstanceConfig) int { return strings.Compare(a.URL, b.URL) })
+			found[service] = instances
+		}
+	}
+	return found, nil
+}
+
+// watchRegistry polls the registry named by the configuration in use and
+// rebuilds the routing table from the configuration file at path whenever
+// the instances it lists change. It never returns.
+func watchRegistry(path string) {
+	failing := false
+	for {
+		registry := currentRoutes.Load().registry
+		if base := registry.address(); base != "" {
+			found, err := fetchInstances(base)
+			switch {
+			case err != nil && !failing:
+				slog.Warn("service registry unavailable, keeping the last known instances", "registry", base, "error", err)
+			case err == nil && failing:
+				slog.Info("service registry available again", "registry", base)
+			}
+			failing = err != nil
+
+			if prev := discovered.Load(); err == nil && (prev == nil || !maps.EqualFunc(*prev, found, slices.Equal)) {
+				before := currentRoutes.Load()
+				discovered.Store(&found)
+				if err := reloadRoutes(path); err != nil {
+					slog.Error("applying discovered instances", "error", err)
+				} else {
+					logDiscovered(before, currentRoutes.Load(), found)
+				}
+			}
+		}
+		time.Sleep(registry.refreshInterval())
+	}
+}
+
+// logDiscovered writes the instances of every upstream whose instances
+// differ between the tables before and after.
+func logDiscovered(before, after *routeTable, found map[string][]InstanceConfig) {
+	for _, name := range slices.Sorted(maps.Keys(after.pools)) {
+		p := after.pools[name]
+		urls := p.urls()
+		if old := before.pools[name]; old != nil && slices.Equal(old.urls(), urls) {
+			continue
+		}
+		source := "registry"
+		if len(found[p.service]) == 0 {
+			source = "config"
+		}
+		slog.Info("upstream instances changed", "upstream", p.serviceName(), "source", source, "instances", urls)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"platform/telemetry"
+)
+
+// Active health check defaults, used when the upstream does not set them.
+const (
+	defaultCheckInterval      = 10 * time.Second
+	defaultCheckTimeout       = 2 * time.Second
+	defaultUnhealthyThreshold = 2
+	defaultHealthyThreshold   = 1
+)
+
+var healthClient = &http.Client{
+	// Probes must not follow redirects to other hosts.
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// healthState is the result of the active checks of one instance.
+type healthState struct {
+	healthy   bool
+	checked   bool
+	lastCheck time.Time
+	latency   time.Duration
+	lastError string
+	// version is taken from the probe answer when the service reports it.
+	version string
+	// successes and failures count consecutive probe results.
+	successes int
+	failures  int
+}
+
+// checker probes the instances of a pool on a fixed interval.
+type checker struct {
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+}
+
+func newChecker(cfg HealthCheckConfig) *checker {
+	if cfg.Path == "" {
+		return nil
+	}
+	c := &checker{
+		path:               cfg.Path,
+		interval:           time.Duration(cfg.Interval),
+		timeout:            time.Duration(cfg.Timeout),
+		unhealthyThreshold: cfg.UnhealthyThreshold,
+		healthyThreshold:   cfg.HealthyThreshold,
+	}
+	if c.interval == 0 {
+		c.interval = defaultCheckInterval
+	}
+	if c.timeout == 0 {
+		c.timeout = defaultCheckTimeout
+	}
+	if c.unhealthyThreshold == 0 {
+		c.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if c.healthyThreshold == 0 {
+		c.healthyThreshold = defaultHealthyThreshold
+	}
+	return c
+}
+
+// run probes every instance of p right away and then on each interval until
+// ctx is cancelled.
+func (c *checker) run(ctx context.Context, p *pool) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, in := range p.instances {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.probe(ctx, p, in)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe performs one check of in and updates its health state. An instance
+// becomes unhealthy after unhealthyThreshold failures in a row and healthy
+// again after healthyThreshold successes.
+func (c *checker) probe(ctx context.Context, p *pool, in *instance) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	version, err := c.get(ctx, in.url.JoinPath(c.path).String())
+	latency := time.Since(start)
+	if ctx.Err() == context.Canceled {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	h := &in.health
+	wasHealthy := h.healthy
+	h.lastCheck = start
+	h.latency = latency
+	if version != "" {
+		h.version = version
+	}
+	if err != nil {
+		h.lastError = err.Error()
+		h.successes = 0
+		h.failures++
+		if !h.checked || h.failures >= c.unhealthyThreshold {
+			h.healthy = false
+		}
+	} else {
+		h.lastError = ""
+		h.failures = 0
+		h.successes++
+		if !h.checked || h.successes >= c.healthyThreshold {
+			h.healthy = true
+		}
+	}
+	h.checked = true
+
+	if wasHealthy != h.healthy {
+		if h.healthy {
+			slog.Info("instance healthy", "upstream", p.name, "instance", in.url.String())
+		} else {
+			slog.Warn("instance unhealthy", "upstream", p.name, "instance", in.url.String(), "error", h.lastError)
+		}
+	}
+}
+
+// probeReport holds the fields read from the services' health report.
+type probeReport struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+}
+
+// get succeeds when url answers with a 2xx or 3xx status. If the answer is
+// a service health report, the reported version is returned.
+func (c *checker) get(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var report probeReport
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&report)
+	if resp.StatusCode >= 400 {
+		if report.Status != "" {
+			return report.Version, fmt.Errorf("status %d (%s)", resp.StatusCode, report.Status)
+		}
+		return report.Version, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return report.Version, nil
+}
+
+// startHealthChecks launches the checkers of every pool of t. They stop when
+// stopHealthChecks is called, once the table is replaced.
+func (t *routeTable) startHealthChecks() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.stopChecks = cancel
+	for _, p := range t.pools {
+		if p.checker != nil {
+			go p.checker.run(ctx, p)
+		}
+	}
+}
+
+func (t *routeTable) stopHealthChecks() {
+	if t.stopChecks != nil {
+		t.stopChecks()
+	}
+}
+
+// instanceStatus is the /health view of one instance.
+type instanceStatus struct {
+	URL            string     `json:"url"`
+	Version        string     `json:"version,omitempty"`
+	Healthy        bool       `json:"healthy"`
+	Ejected        bool       `json:"ejected"`
+	ActiveRequests int64      `json:"active_requests"`
+	LatencyMS      float64    `json:"latency_ms,omitempty"`
+	LastCheck      *time.Time `json:"last_check,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// serviceStatus is the /health view of one upstream.
+type serviceStatus struct {
+	Status           string           `json:"status"`
+	Required         bool             `json:"required"`
+	HealthyInstances int              `json:"healthy_instances"`
+	Instances        []instanceStatus `json:"instances"`
+	CircuitBreaker   breakerStatus    `json:"circuit_breaker"`
+}
+
+// status summarizes the pool: "up" when every instance can take traffic,
+// "degraded" when only some can and "down" when none can or the circuit
+// breaker is open.
+func (p *pool) status() serviceStatus {
+	now := time.Now()
+	s := serviceStatus{Required: p.required, Instances: []instanceStatus{}, CircuitBreaker: p.breaker.status()}
+	for _, in := range p.instances {
+		in.mu.Lock()
+		is := instanceStatus{
+			URL:            in.url.String(),
+			Version:        in.health.version,
+			Healthy:        in.health.healthy,
+			Ejected:        now.Before(in.ejectedUntil),
+			ActiveRequests: in.active.Load(),
+			LastError:      in.health.lastError,
+		}
+		if in.health.checked {
+			lastCheck := in.health.lastCheck
+			is.LastCheck = &lastCheck
+			is.LatencyMS = float64(in.health.latency.Microseconds()) / 1000
+		}
+		in.mu.Unlock()
+
+		if is.Healthy && !is.Ejected {
+			s.HealthyInstances++
+		}
+		s.Instances = append(s.Instances, is)
+	}
+
+	switch {
+	case s.HealthyInstances == 0 || s.CircuitBreaker.State == breakerOpen:
+		s.Status = "down"
+	case s.HealthyInstances == len(s.Instances) && s.CircuitBreaker.State == breakerClosed:
+		s.Status = "up"
+	default:
+		s.Status = "degraded"
+	}
+	return s
+}
+
+// healthCheck reports the gateway status together with every upstream. The
+// answer is 503 when a required service has no instance able to serve.
+func healthCheck(w http.ResponseWriter, r *http.Request) {
+	overall, code := "healthy", http.StatusOK
+	services := map[string]serviceStatus{}
+	for name, p := range currentRoutes.Load().pools {
+		s := p.status()
+		services[name] = s
+		switch {
+		case s.Status == "down" && s.Required:
+			overall, code = "unhealthy", http.StatusServiceUnavailable
+		case s.Status != "up" && overall == "healthy":
+			overall = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":   overall,
+		"gateway":  "running",
+		"services": services,
+		"cache":    currentRoutes.Load().cache.snapshot(),
+	})
+}
+
+// registerHealthMetrics exposes on /metrics the state /health reports: the
+// instances and circuit breaker of every upstream, and the response cache.
+func registerHealthMetrics() {
+	eachPool := func(fn func(name string, s serviceStatus)) {
+		pools := currentRoutes.Load().pools
+		for _, name := range slices.Sorted(maps.Keys(pools)) {
+			fn(name, pools[name].status())
+		}
+	}
+	telemetry.NewCollected("gateway_upstream_instances", "Configured instances of each upstream.", "gauge",
+		[]string{"upstream"}, func(emit func(float64, ...string)) {
+			eachPool(func(name string, s serviceStatus) { emit(float64(len(s.Instances)), name) })
+		})
+	telemetry.NewCollected("gateway_upstream_healthy_instances", "Instances of each upstream passing health checks and not ejected.", "gauge",
+		[]string{"upstream"}, func(emit func(float64, ...string)) {
+			eachPool(func(name string, s serviceStatus) { emit(float64(s.HealthyInstances), name) })
+		})
+	telemetry.NewCollected("gateway_upstream_active_requests", "Requests in progress on each upstream instance.", "gauge",
+		[]string{"upstream", "instance"}, func(emit func(float64, ...string)) {
+			eachPool(func(name string, s serviceStatus) {
+				for _, in := range s.Instances {
+					emit(float64(in.ActiveRequests), name, in.URL)
+				}
+			})
+		})
+	telemetry.NewCollected("gateway_circuit_breaker_state", "Circuit breaker state of each upstream: 1 for the current state, 0 for the others.", "gauge",
+		[]string{"upstream", "state"}, func(emit func(float64, ...string)) {
+			eachPool(func(name string, s serviceStatus) {
+				for _, state := range []string{breakerClosed, breakerHalfOpen, breakerOpen} {
+					v := 0.0
+					if s.CircuitBreaker.State == state {
+						v = 1
+					}
+					emit(v, name, state)
+				}
+			})
+		})
+
+	cacheStat := func(name, help, kind string, value func(cacheStats) float64) {
+		telemetry.NewCollected(name, help, kind, nil, func(emit func(float64, ...string)) {
+			emit(value(currentRoutes.Load().cache.snapshot()))
+		})
+	}
+	cacheStat("gateway_cache_entries", "Responses held by the cache.", "gauge",
+		func(s cacheStats) float64 { return float64(s.Entries) })
+	cacheStat("gateway_cache_hits_total", "Requests answered from a fresh cached response.", "counter",
+		func(s cacheStats) float64 { return float64(s.Hits) })
+	cacheStat("gateway_cache_misses_total", "Cacheable requests not answered from a fresh entry.", "counter",
+		func(s cacheStats) float64 { return float64(s.Misses) })
+	cacheStat("gateway_cache_revalidations_total", "Stale entries the upstream confirmed with 304.", "counter",
+		func(s cacheStats) float64 { return float64(s.Revalidations) })
+	cacheStat("gateway_cache_stores_total", "Responses stored in the cache.", "counter",
+		func(s cacheStats) float64 { return float64(s.Stores) })
+	cacheStat("gateway_cache_evictions_total", "Entries evicted to stay within the cache limits.", "counter",
+		func(s cacheStats) float64 { return float64(s.Evictions) })
+}
@@ -1,103 +1,143 @@
 package main
 
 import (
-	"fmt"
-	"io"
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"strings"
-)
+	"time"
 
-const (
-	usersServiceURL   = "http://localhost:8081"
-	ordersServiceURL  = "http://localhost:8082"
-	billingServiceURL = "http://localhost:8083"
+	"platform/authz"
+	"platform/discovery"
+	"platform/server"
+	"platform/telemetry"
 )
 
 // Gateway routes incoming requests to the appropriate microservice
 func gatewayHandler(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
-	query := r.URL.RawQuery
-
-	var targetURL string
-	var serviceName string
 
-	// Route determination based on path
-	switch {
-	case strings.HasPrefix(path, "/api/users"):
-		targetURL = usersServiceURL + strings.TrimPrefix(path, "/api")
-		serviceName = "USERS"
-	case strings.HasPrefix(path, "/api/user"):
-		targetURL = usersServiceURL + strings.TrimPrefix(path, "/api")
-		serviceName = "USERS"
-	case strings.HasPrefix(path, "/api/orders"):
-		targetURL = ordersServiceURL + strings.TrimPrefix(path, "/api")
-		serviceName = "ORDERS"
-	case strings.HasPrefix(path, "/api/order"):
-		targetURL = ordersServiceURL + strings.TrimPrefix(path, "/api")
-		serviceName = "ORDERS"
-	case strings.HasPrefix(path, "/api/invoices"):
-		targetURL = billingServiceURL + strings.TrimPrefix(path, "/api")
-		serviceName = "BILLING"
-	case strings.HasPrefix(path, "/api/invoice"):
-		targetURL = billingServiceURL + strings.TrimPrefix(path, "/api")
-		serviceName = "BILLING"
-	default:
+	// Route determination based on the configured prefixes
+	table := currentRoutes.Load()
+	rt := table.match(path)
+	if rt == nil {
 		http.Error(w, "Service not found", http.StatusNotFound)
-		log.Printf("[GATEWAY] Unknown route: %s\n", path)
+		slog.DebugContext(r.Context(), "unknown route", "path", path)
 		return
 	}
+	if s := telemetry.SpanFrom(r.Context()); s != nil {
+		s.SetName(r.Method + " " + rt.Prefix)
+		s.SetAttribute("http.route", rt.Prefix)
+	}
+	telemetry.SetMetricsRoute(r.Context(), rt.Prefix)
 
-	if query != "" {
-		targetURL += "?" + query
+	if !rt.allows(r.Method) {
+		w.Header().Set("Allow", strings.Join(rt.Methods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		slog.DebugContext(r.Context(), "method not allowed", "method", r.Method, "route", rt.Prefix)
+		return
 	}
 
-	log.Printf("[GATEWAY] Routing %s %s -> %s Service (%s)\n", r.Method, path, serviceName, targetURL)
+	r, ok := table.authenticate(w, r, rt.Public)
+	if !ok {
+		return
+	}
+	if id, s := identityFrom(r.Context()), telemetry.SpanFrom(r.Context()); id != nil && s != nil {
+		s.SetAttribute("enduser.id", id.Subject)
+	}
+	if !rt.authorize(w, r) || !table.rateLimit(w, r, rt) {
+		return
+	}
+
+	if rt.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(rt.Timeout))
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
 
 	// Forward the request to the appropriate service
-	resp, err := http.Get(targetURL)
-	if err != nil {
-		log.Printf("[GATEWAY] Error forwarding to %s: %v\n", serviceName, err)
-		http.Error(w, fmt.Sprintf("Error contacting %s service", serviceName), http.StatusBadGateway)
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+	if rt.Cache != nil && r.Method != http.MethodOptions && safe {
+		table.serveCached(w, r, rt)
 		return
 	}
-	defer resp.Body.Close()
-
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	forwardRequest(w, r, rt)
+	if !safe {
+		// The request may have changed what the upstream's cached
+		// responses show.
+		table.cache.invalidate(rt.Upstream)
 	}
+}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+func main() {
+	srvFlags := server.DefineFlags(":8090")
+	configPath := server.EnvString("config", "GATEWAY_CONFIG", "config.json", "routing configuration file")
+	auditPath := server.EnvString("audit-log", "AUDIT_LOG", "data/audit.jsonl", "file the denied requests are recorded in")
+	keysPath := server.EnvString("api-keys", "API_KEYS_FILE", "data/api_keys.json", "file holding the API keys")
+	registry := server.EnvString("registry", "REGISTRY_URL", "", "service registry to register with and discover upstreams from")
+	logLevel := server.EnvString("log-level", "LOG_LEVEL", "info", "debug, info, warn or error")
+	flagErr := server.ParseFlags()
+	if err := telemetry.InitLogging("gateway", *logLevel); err != nil {
+		log.Fatalf("[GATEWAY] Logging: %v\n", err)
+	}
+	if flagErr != nil {
+		telemetry.Fatal("invalid settings", "error", flagErr)
+	}
+	flushTraces, err := telemetry.InitTracing("gateway")
+	if err != nil {
+		telemetry.Fatal("setting up tracing", "error", err)
+	}
+	defer flushTraces()
 
-	// Copy response body
-	io.Copy(w, resp.Body)
+	registryURL = *registry
+	if err := reloadRoutes(*configPath); err != nil {
+		telemetry.Fatal("invalid configuration", "path", *configPath, "error", err)
+	}
+	go watchConfig(*configPath)
+	go watchRegistry(*configPath)
 
-	log.Printf("[GATEWAY] Response from %s Service: %d\n", serviceName, resp.StatusCode)
-}
+	if err := authz.OpenAuditLog("gateway", *auditPath); err != nil {
+		telemetry.Fatal("opening audit log", "error", err)
+	}
+	if err := authz.LoadServiceToken(); err != nil {
+		telemetry.Fatal("reading the service token", "error", err)
+	}
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	log.Println("[GATEWAY] Health check")
-	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"status":"healthy","gateway":"running"}`))
-}
+	keys, err := openAPIKeys(*keysPath)
+	if err != nil {
+		telemetry.Fatal("opening API keys", "error", err)
+	}
+	apiKeys = keys
+	defer func() {
+		if err := keys.close(); err != nil {
+			slog.Error("saving API key usage", "error", err)
+		}
+	}()
 
-func main() {
+	registerHealthMetrics()
 	http.HandleFunc("/health", healthCheck)
+	http.HandleFunc("GET /metrics", telemetry.ServeMetrics)
+	http.HandleFunc("GET /admin/api-keys", listAPIKeys)
+	http.HandleFunc("POST /admin/api-keys", issueAPIKey)
+	http.HandleFunc("GET /admin/api-keys/{id}", getAPIKey)
+	http.HandleFunc("DELETE /admin/api-keys/{id}", revokeAPIKey)
+	http.HandleFunc(profilePrefix, profileHandler)
 	http.HandleFunc("/api/", gatewayHandler)
 
-	port := ":8090"
-	log.Println("=================================================")
-	log.Println("         API GATEWAY - Sistema SBA")
-	log.Println("=================================================")
-	log.Printf("[GATEWAY] Started on port %s\n", port)
-	log.Println("[GATEWAY] Routing:")
-	log.Println("  - /api/users, /api/user -> Users Service (8081)")
-	log.Println("  - /api/orders, /api/order -> Orders Service (8082)")
-	log.Println("  - /api/invoices, /api/invoice -> Billing Service (8083)")
-	log.Println("=================================================")
-	log.Fatal(http.ListenAndServe(port, nil))
+	deregister, err := discovery.Register(*registry, "gateway", "", *srvFlags.Addr, nil)
+	if err != nil {
+		telemetry.Fatal("registering with the service registry", "error", err)
+	}
+	slog.Info("API Gateway - Sistema SBA started", "addr", *srvFlags.Addr, "config", *configPath)
+	for _, rt := range currentRoutes.Load().routes {
+		slog.Info("route", "prefix", rt.Prefix, "upstream", rt.serviceName(), "strategy", rt.pool.strategy, "instances", rt.pool.urls())
+	}
+	slog.Info("route", "prefix", profilePrefix, "upstream", "composed from USERS, ORDERS and BILLING")
+	slog.Info("route", "prefix", "/admin/api-keys", "upstream", "API key management (admin only)")
+	srv := srvFlags.Server(telemetry.Handler(http.DefaultServeMux))
+	if err := server.Serve(srv, *srvFlags.ShutdownTimeout, deregister); err != nil {
+		telemetry.Fatal("server stopped", "error", err)
+	}
+	slog.Info("stopped")
 }
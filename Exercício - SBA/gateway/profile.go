@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"platform/telemetry"
+)
+
+// Upstreams queried to compose a user profile.
+const (
+	profileUsersUpstream   = "users"
+	profileOrdersUpstream  = "orders"
+	profileBillingUpstream = "billing"
+)
+
+// profilePrefix is the path /api/profile is served at.
+const profilePrefix = "/api/profile"
+
+// profileTimeout bounds each call made to compose a profile.
+const profileTimeout = 5 * time.Second
+
+// maxSectionBody is the largest answer accepted from a service for one
+// section of a profile.
+const maxSectionBody = 10 << 20
+
+// compositionTransport is used for the calls made by the gateway itself.
+var compositionTransport http.RoundTripper = http.DefaultTransport
+
+// sectionError explains why one section of a composed document is missing.
+type sectionError struct {
+	// Status is the HTTP status the service answered with, or the one the
+	// gateway would have answered with when the call failed.
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// profile is the document served by /api/profile: the user, their orders
+// and the invoice of each order. Sections that could not be fetched are
+// left empty and explained in Errors.
+type profile struct {
+	UserID  string                   `json:"user_id"`
+	User    json.RawMessage          `json:"user"`
+	Orders  []map[string]any         `json:"orders"`
+	Partial bool                     `json:"partial"`
+	Errors  map[string]*sectionError `json:"errors,omitempty"`
+}
+
+// profileHandler fans out to the users, orders and billing services at once
+// and joins their answers into a single profile. When a service fails the
+// other sections are still returned, with partial set; only a missing user
+// (404), a user the caller may not see (403) or every service failing (502)
+// fails the whole request.
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	table := currentRoutes.Load()
+	r, ok := table.authenticate(w, r, false)
+	if !ok || !table.profile.authorize(w, r) || !table.rateLimit(w, r, table.profile) {
+		return
+	}
+	userID := r.URL.Query().Get("user_id")
+	if userID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	slog.DebugContext(r.Context(), "composing profile", "user_id", userID)
+
+	query := url.Values{"user_id": {userID}}
+	var (
+		user     json.RawMessage
+		orders   []map[string]any
+		invoices []map[string]any
+		errs     = map[string]*sectionError{}
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+	)
+	fetch := func(section, upstream, path string, query url.Values, out any) {
+		defer wg.Done()
+		if err := fetchSection(r, table, upstream, path, query, out); err != nil {
+			slog.WarnContext(r.Context(), "profile section failed", "user_id", userID, "section", section, "status", err.Status, "error", err.Error)
+			mu.Lock()
+			errs[section] = err
+			mu.Unlock()
+		}
+	}
+	wg.Add(3)
+	go fetch("user", profileUsersUpstream, "/user", url.Values{"id": {userID}}, &user)
+	go fetch("orders", profileOrdersUpstream, "/orders/user", query, &orders)
+	go fetch("invoices", profileBillingUpstream, "/invoices/user", query, &invoices)
+	wg.Wait()
+
+	if err := errs["user"]; err != nil {
+		switch err.Status {
+		case http.StatusNotFound:
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		case http.StatusForbidden:
+			// The users service already audited the denial.
+			http.Error(w, "Forbidden: "+err.Error, http.StatusForbidden)
+			return
+		}
+	}
+	if len(errs) == 3 {
+		http.Error(w, "Could not reach any service to compose the profile", http.StatusBadGateway)
+		return
+	}
+
+	// Attach each order's invoice, matched by order ID.
+	byOrder := map[any]map[string]any{}
+	for _, inv := range invoices {
+		byOrder[inv["order_id"]] = inv
+	}
+	for _, order := range orders {
+		if inv, ok := byOrder[order["id"]]; ok {
+			order["invoice"] = inv
+		} else {
+			order["invoice"] = nil
+		}
+	}
+
+	doc := profile{UserID: userID, User: user, Orders: orders, Partial: len(errs) > 0}
+	if doc.User == nil {
+		doc.User = json.RawMessage("null")
+	}
+	if doc.Orders == nil {
+		doc.Orders = []map[string]any{}
+	}
+	if len(errs) > 0 {
+		doc.Errors = errs
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// fetchSection GETs path on upstream, with the caller's end-to-end headers,
+// and decodes the JSON answer into out. The call goes through the
+// upstream's circuit breaker and load balancer like any proxied request.
+func fetchSection(r *http.Request, table *routeTable, upstream, path string, query url.Values, out any) *sectionError {
+	p := table.pools[upstream]
+	if p == nil {
+		return &sectionError{http.StatusBadGateway, fmt.Sprintf("upstream %q is not configured", upstream)}
+	}
+	serviceName := p.serviceName()
+
+	breakerDone, _, err := p.breaker.allow()
+	if err != nil {
+		return &sectionError{http.StatusServiceUnavailable, serviceName + " service unavailable (circuit open)"}
+	}
+	in, err := p.pick()
+	if err != nil {
+		breakerDone(outcomeFailure)
+		return &sectionError{http.StatusServiceUnavailable, serviceName + " service unavailable"}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), profileTimeout)
+	defer cancel()
+	target := in.url.JoinPath(path)
+	target.RawQuery = query.Encode()
+	sub := r.Clone(ctx)
+	sub.Method, sub.Body, sub.ContentLength = http.MethodGet, http.NoBody, 0
+	// The answer is decoded here, so it must be plain and complete.
+	for _, name := range []string{"Accept-Encoding", "Range", "If-None-Match", "If-Modified-Since"} {
+		sub.Header.Del(name)
+	}
+	outReq, err := newUpstreamRequest(sub, target.String())
+	if err != nil {
+		p.done(in, nil)
+		breakerDone(outcomeAbandoned)
+		return &sectionError{http.StatusBadGateway, err.Error()}
+	}
+	spanCtx, span := telemetry.StartSpan(ctx, "GET "+serviceName, telemetry.SpanKindClient)
+	span.SetAttribute("url.full", target.String())
+	telemetry.InjectTrace(spanCtx, outReq.Header)
+
+	sent := time.Now()
+	resp, err := compositionTransport.RoundTrip(outReq)
+	p.done(in, err)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+		span.SetAttribute("http.response.status_code", status)
+	}
+	observeUpstream(p.name, sent, status, err)
+	breakerDone(requestOutcome(status, err))
+	if isFailure(status, err) {
+		span.Fail(cmp.Or(err, fmt.Errorf("upstream answered %d", status)))
+	}
+	span.Finish()
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &sectionError{http.StatusGatewayTimeout, serviceName + " service timed out"}
+		}
+		return &sectionError{http.StatusBadGateway, "Error contacting " + serviceName + " service"}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSectionBody))
+	if err != nil {
+		return &sectionError{http.StatusBadGateway, "Error reading " + serviceName + " answer: " + err.Error()}
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = http.StatusText(resp.StatusCode)
+		}
+		return &sectionError{resp.StatusCode, apiErr.Error}
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return &sectionError{http.StatusBadGateway, "Invalid answer from " + serviceName + " service: " + err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/authz"
+	"platform/telemetry"
+)
+
+// hopHeaders describe a single transport-level connection and must not be
+// forwarded by a proxy in either direction (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the standard hop-by-hop headers and any header
+// named in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// newUpstreamRequest builds the request sent to a service from the incoming
+// one, keeping method, body and end-to-end headers.
+func newUpstreamRequest(r *http.Request, targetURL string) (*http.Request, error) {
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.ContentLength = r.ContentLength
+	outReq.Header = r.Header.Clone()
+	removeHopHeaders(outReq.Header)
+	// The services believe the identity headers set by authenticate only
+	// from a request carrying the service token.
+	authz.Vouch(outReq.Header, "")
+
+	// Let the service know who originally made the request.
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := outReq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		outReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	outReq.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		outReq.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		outReq.Header.Set("X-Forwarded-Proto", "http")
+	}
+	return outReq, nil
+}
+
+// writeUpstreamResponse streams resp back to the caller, flushing as data
+// arrives so long-running responses are not held back by the gateway.
+func writeUpstreamResponse(w http.ResponseWriter, resp *http.Response) error {
+	removeHopHeaders(resp.Header)
+	// The upstream echoes the request ID telemetry.Handler already set; it must
+	// not be doubled, nor stored with a cached response.
+	resp.Header.Del(telemetry.HeaderRequestID)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+
+	// Announce trailers so they can be sent after the body.
+	for key := range resp.Trailer {
+		w.Header().Add("Trailer", key)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	if err := copyFlushing(w, resp.Body); err != nil {
+		return err
+	}
+
+	for key, values := range resp.Trailer {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	return nil
+}
+
+// copyFlushing copies src to w, flushing after every chunk.
+func copyFlushing(w http.ResponseWriter, src io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// Upstream call metrics, observed once per attempt.
+var (
+	upstreamRequests = telemetry.NewCounter("gateway_upstream_requests_total",
+		"Requests sent to upstream instances, by upstream and status class (\"error\" when no answer came).", "upstream", "status_class")
+	upstreamDuration = telemetry.NewHistogram("gateway_upstream_request_duration_seconds",
+		"Time until upstream instances answered, by upstream.", telemetry.DefaultBuckets, "upstream")
+)
+
+// observeUpstream records an upstream call started at start.
+func observeUpstream(upstream string, start time.Time, status int, err error) {
+	class := "error"
+	if err == nil {
+		class = telemetry.StatusClass(status)
+	}
+	upstreamRequests.Inc(upstream, class)
+	upstreamDuration.Since(start, upstream)
+}
+
+// forwardRequest proxies r through rt and streams the answer back to w.
+// Each attempt goes through the upstream's circuit breaker and load
+// balancer; failed idempotent requests are retried with backoff while the
+// route allows it and the upstream's retry budget is not spent.
+func forwardRequest(w http.ResponseWriter, r *http.Request, rt *route) {
+	serviceName := rt.serviceName()
+
+	retries := 0
+	var body []byte
+	if rt.retry.maxRetries > 0 && isIdempotent(r.Method) {
+		var ok bool
+		if body, ok = bufferBody(r); ok {
+			retries = rt.retry.maxRetries
+		}
+	}
+	rt.pool.budget.recordRequest()
+
+	for attempt := 0; ; attempt++ {
+		breakerDone, retryAfter, err := rt.pool.breaker.allow()
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, serviceName+" service unavailable (circuit open)", http.StatusServiceUnavailable)
+			slog.WarnContext(r.Context(), "circuit breaker open, rejecting request", "upstream", serviceName)
+			return
+		}
+
+		in, err := rt.pool.pick()
+		if err != nil {
+			breakerDone(outcomeFailure)
+			http.Error(w, serviceName+" service unavailable", http.StatusServiceUnavailable)
+			slog.WarnContext(r.Context(), "no instance available", "upstream", serviceName)
+			return
+		}
+
+		targetURL := rt.targetURL(in.url, r.URL)
+		ctx, span := telemetry.StartSpan(r.Context(), r.Method+" "+serviceName, telemetry.SpanKindClient)
+		span.SetAttribute("url.full", targetURL)
+		if attempt > 0 {
+			span.SetAttribute("http.request.resend_count", attempt)
+		}
+		outReq, err := newUpstreamRequest(r, targetURL)
+		if err != nil {
+			span.Fail(err)
+			span.Finish()
+			rt.pool.done(in, nil)
+			breakerDone(outcomeAbandoned)
+			slog.WarnContext(r.Context(), "building upstream request", "upstream", serviceName, "error", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if body != nil {
+			outReq.Body = io.NopCloser(bytes.NewReader(body))
+			outReq.ContentLength = int64(len(body))
+		}
+		slog.DebugContext(r.Context(), "forwarding request", "upstream", serviceName, "url", targetURL, "attempt", attempt)
+
+		telemetry.InjectTrace(ctx, outReq.Header)
+
+		sent := time.Now()
+		resp, err := rt.transport.RoundTrip(outReq)
+		rt.pool.done(in, err)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			span.SetAttribute("http.response.status_code", status)
+		}
+		observeUpstream(rt.pool.name, sent, status, err)
+		breakerDone(requestOutcome(status, err))
+		if isFailure(status, err) {
+			span.Fail(cmp.Or(err, fmt.Errorf("upstream answered %d", status)))
+		}
+		span.Finish()
+
+		if attempt < retries && shouldRetry(r.Context(), status, err) {
+			if rt.pool.budget.allowRetry() {
+				if resp != nil {
+					slog.WarnContext(r.Context(), "retrying after upstream answer", "upstream", serviceName, "status", status, "attempt", attempt+1, "retries", retries)
+					io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+					resp.Body.Close()
+				} else {
+					slog.WarnContext(r.Context(), "retrying after upstream error", "upstream", serviceName, "error", err, "attempt", attempt+1, "retries", retries)
+				}
+				if sleepContext(r.Context(), rt.retry.backoff(attempt+1)) {
+					continue
+				}
+				writeProxyError(w, r, serviceName, r.Context().Err())
+				return
+			}
+			slog.WarnContext(r.Context(), "retry budget exhausted, not retrying", "upstream", serviceName)
+		}
+
+		if err != nil {
+			writeProxyError(w, r, serviceName, err)
+			return
+		}
+		slog.DebugContext(r.Context(), "upstream response", "upstream", serviceName, "status", status)
+		if err := writeUpstreamResponse(w, resp); err != nil {
+			slog.WarnContext(r.Context(), "streaming upstream response", "upstream", serviceName, "error", err)
+		}
+		resp.Body.Close()
+		return
+	}
+}
+
+// bufferBody reads the body of r into memory so it can be sent more than
+// once. ok is false when the body is larger than maxRetryBody; r.Body is then
+// left able to stream the whole body once.
+func bufferBody(r *http.Request) (body []byte, ok bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > maxRetryBody {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRetryBody+1))
+	if err != nil || len(body) > maxRetryBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	return body, true
+}
+
+// readCloser joins a reader with the Closer of the body it was built from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writeProxyError answers a request whose upstream call failed: 504 when it
+// timed out, 502 for any other error. Nothing is written when the caller
+// has gone away.
+func writeProxyError(w http.ResponseWriter, r *http.Request, serviceName string, err error) {
+	slog.WarnContext(r.Context(), "forwarding request", "upstream", serviceName, "error", err)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		http.Error(w, serviceName+" service timed out", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, "Error contacting "+serviceName+" service", http.StatusBadGateway)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/telemetry"
+)
+
+// Rate limit keys: whose requests to a route share a bucket.
+const (
+	rateLimitPerClient = "client"
+	rateLimitPerIP     = "ip"
+	rateLimitPerRoute  = "route"
+)
+
+// rateDecision is the outcome of taking a token from a bucket.
+type rateDecision struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is the time until the bucket is full again.
+	reset time.Duration
+	// retryAfter is the time until the next request would be allowed; zero
+	// when this one was.
+	retryAfter time.Duration
+}
+
+// rateStore keeps the token buckets of the rate limits.
+type rateStore interface {
+	take(key string, limit RateLimitConfig, now time.Time) (rateDecision, error)
+}
+
+// bucket is the state of one token bucket.
+type bucket struct {
+	tokens float64
+	// updated is when tokens was last computed, in Unix nanoseconds; zero
+	// for a bucket never used, which starts full.
+	updated int64
+}
+
+// take refills b for the time elapsed since its last use and takes one
+// token if there is one.
+func (b *bucket) take(limit RateLimitConfig, now time.Time) rateDecision {
+	capacity := float64(limit.Burst)
+	if b.updated == 0 {
+		b.tokens = capacity
+	} else if elapsed := now.UnixNano() - b.updated; elapsed > 0 {
+		b.tokens = min(capacity, b.tokens+time.Duration(elapsed).Seconds()*limit.Rate)
+	}
+	b.updated = now.UnixNano()
+
+	d := rateDecision{limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = seconds((capacity - b.tokens) / limit.Rate)
+	return d
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// memoryRateStore keeps the buckets of one gateway instance.
+type memoryRateStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	// fullAt is when the bucket will be full again; past that point it is
+	// no different from a new one and can be dropped.
+	fullAt time.Time
+}
+
+func newMemoryRateStore() *memoryRateStore {
+	return &memoryRateStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *memoryRateStore) take(key string, limit RateLimitConfig, now time.Time) (rateDecision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.fullAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	d := b.take(limit, now)
+	b.fullAt = now.Add(d.reset)
+	return d, nil
+}
+
+var rateLimited = telemetry.NewCounter("gateway_rate_limited_total",
+	"Requests rejected with 429 by the rate limits, by route (auth for the limit on credentials).", "route")
+
+// defaultAuthRateLimit caps how often one IP address may present
+// credentials when the auth section does not say.
+var defaultAuthRateLimit = RateLimitConfig{Rate: 20, Burst: 40, Per: rateLimitPerIP}
+
+// authRateLimitName is the name the rate limit on credentials is counted and
+// reported under, beside the route prefixes.
+const authRateLimitName = "auth"
+
+// rateLimit applies the route's rate limit to r, setting the RateLimit
+// headers. When the limit is exceeded a 429 is written and ok is false. If
+// the store fails the request is let through: an unavailable limiter must
+// not take the API down with it.
+func (t *routeTable) rateLimit(w http.ResponseWriter, r *http.Request, rt *route) (ok bool) {
+	if rt.RateLimit == nil {
+		return true
+	}
+	return t.take(w, r, rt.Prefix, *rt.RateLimit)
+}
+
+// limitAuth applies the rate limit on credentials to the IP address of r,
+// as rateLimit does for routes.
+func (t *routeTable) limitAuth(w http.ResponseWriter, r *http.Request) (ok bool) {
+	return t.take(w, r, authRateLimitName, t.authLimit)
+}
+
+// take counts r in the bucket of its client under the limit called name.
+func (t *routeTable) take(w http.ResponseWriter, r *http.Request, name string, limit RateLimitConfig) (ok bool) {
+	client := rateLimitClient(r, limit.Per)
+	d, err := t.limiter.take(name+" "+client, limit, time.Now())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "rate limit store", "error", err)
+		return true
+	}
+
+	h := w.Header()
+	h.Set("RateLimit-Policy", strconv.Itoa(limit.Burst)+";w="+strconv.Itoa(ceilSeconds(seconds(float64(limit.Burst)/limit.Rate))))
+	h.Set("RateLimit-Limit", strconv.Itoa(d.limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(d.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+	if d.allowed {
+		return true
+	}
+	h.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(d.retryAfter))))
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	rateLimited.Inc(name)
+	slog.InfoContext(r.Context(), "rate limit exceeded", "route", name, "client", client)
+	return false
+}
+
+// rateLimitClient names the bucket r is counted in, within its route.
+func rateLimitClient(r *http.Request, per string) string {
+	switch per {
+	case rateLimitPerRoute:
+		return "*"
+	case rateLimitPerIP:
+	default:
+		if id := identityFrom(r.Context()); id != nil {
+			return "sub:" + id.Subject
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
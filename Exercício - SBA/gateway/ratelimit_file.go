@@ -0,0 +1,100 @@
+//go:build unix
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fileRateStore keeps the buckets in a directory, one small file per bucket,
+// so that every gateway instance pointed at the same directory enforces the
+// same limits. Each update holds an exclusive flock on the bucket's file.
+type fileRateStore struct {
+	dir string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// bucketRecordSize is the size of a bucket file: tokens, updated and the
+// time the bucket is full again, eight bytes each.
+const bucketRecordSize = 24
+
+func newFileRateStore(dir string) (*fileRateStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileRateStore{dir: dir}, nil
+}
+
+func (s *fileRateStore) take(key string, limit RateLimitConfig, now time.Time) (rateDecision, error) {
+	s.sweep(now)
+
+	sum := sha256.Sum256([]byte(key))
+	f, err := os.OpenFile(filepath.Join(s.dir, hex.EncodeToString(sum[:16])), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return rateDecision{}, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return rateDecision{}, fmt.Errorf("locking %s: %w", f.Name(), err)
+	}
+
+	var b bucket
+	var rec [bucketRecordSize]byte
+	if n, _ := f.ReadAt(rec[:], 0); n == bucketRecordSize {
+		b.tokens = math.Float64frombits(binary.LittleEndian.Uint64(rec[0:]))
+		b.updated = int64(binary.LittleEndian.Uint64(rec[8:]))
+	}
+	d := b.take(limit, now)
+	binary.LittleEndian.PutUint64(rec[0:], math.Float64bits(b.tokens))
+	binary.LittleEndian.PutUint64(rec[8:], uint64(b.updated))
+	binary.LittleEndian.PutUint64(rec[16:], uint64(now.Add(d.reset).UnixNano()))
+	if _, err := f.WriteAt(rec[:], 0); err != nil {
+		return rateDecision{}, err
+	}
+	// Closing the file releases the lock.
+	return d, nil
+}
+
+// sweep removes, at most once a minute, the files of buckets that have
+// refilled completely and so are no different from missing ones.
+func (s *fileRateStore) sweep(now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastSweep) < time.Minute {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSweep = now
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		path := filepath.Join(s.dir, e.Name())
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+			var rec [bucketRecordSize]byte
+			// An instance already waiting for this lock updates the removed
+			// file, losing one request from a bucket that was full anyway.
+			if n, _ := f.ReadAt(rec[:], 0); n == bucketRecordSize && now.UnixNano() > int64(binary.LittleEndian.Uint64(rec[16:])) {
+				os.Remove(path)
+			}
+		}
+		f.Close()
+	}
+}
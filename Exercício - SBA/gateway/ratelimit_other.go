@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// fileRateStore needs flock, which this platform lacks.
+type fileRateStore struct{}
+
+func newFileRateStore(dir string) (*fileRateStore, error) {
+	return nil, errors.New("rate_limit_store is only supported on Unix systems")
+}
+
+func (s *fileRateStore) take(key string, limit RateLimitConfig, now time.Time) (rateDecision, error) {
+	return rateDecision{}, errors.ErrUnsupported
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	limit := RateLimitConfig{Rate: 2, Burst: 3}
+	start := time.Unix(1_000_000, 0)
+	var b bucket
+
+	type step struct {
+		after         time.Duration // since start
+		wantAllowed   bool
+		wantRemaining int
+	}
+	steps := []step{
+		// A new bucket starts full and drains one token per request.
+		{0, true, 2},
+		{0, true, 1},
+		{0, true, 0},
+		{0, false, 0},
+		// Two tokens a second: after 250ms half a token is back.
+		{250 * time.Millisecond, false, 0},
+		{500 * time.Millisecond, true, 0},
+		// Refilling stops at the burst.
+		{time.Hour, true, 2},
+		{time.Hour, true, 1},
+	}
+	for i, s := range steps {
+		d := b.take(limit, start.Add(s.after))
+		if d.allowed != s.wantAllowed || d.remaining != s.wantRemaining {
+			t.Errorf("step %d (+%v): allowed %v remaining %d, want %v %d", i, s.after, d.allowed, d.remaining, s.wantAllowed, s.wantRemaining)
+		}
+		if d.limit != limit.Burst {
+			t.Errorf("step %d: limit %d, want %d", i, d.limit, limit.Burst)
+		}
+	}
+}
+
+func TestBucketRetryAfterAndReset(t *testing.T) {
+	limit := RateLimitConfig{Rate: 4, Burst: 2}
+	now := time.Unix(1_000_000, 0)
+	var b bucket
+	b.take(limit, now)
+	b.take(limit, now)
+
+	d := b.take(limit, now)
+	if d.allowed {
+		t.Fatal("request allowed from an empty bucket")
+	}
+	if d.retryAfter != 250*time.Millisecond {
+		t.Errorf("retryAfter = %v, want 250ms", d.retryAfter)
+	}
+	if d.reset != 500*time.Millisecond {
+		t.Errorf("reset = %v, want 500ms", d.reset)
+	}
+}
+
+func TestMemoryRateStoreKeysAreSeparate(t *testing.T) {
+	s := newMemoryRateStore()
+	limit := RateLimitConfig{Rate: 1, Burst: 1}
+	now := time.Now()
+	if d, _ := s.take("a", limit, now); !d.allowed {
+		t.Fatal("first request of a rejected")
+	}
+	if d, _ := s.take("a", limit, now); d.allowed {
+		t.Error("second request of a allowed")
+	}
+	if d, _ := s.take("b", limit, now); !d.allowed {
+		t.Error("first request of b rejected")
+	}
+}
+
+// Credentials are limited by IP address before they are checked, so bad
+// tokens use up the bucket too.
+func TestAuthenticateRateLimitsBeforeChecking(t *testing.T) {
+	table := &routeTable{
+		verifier:  &tokenVerifier{},
+		limiter:   newMemoryRateStore(),
+		authLimit: RateLimitConfig{Rate: 0.001, Burst: 2, Per: rateLimitPerIP},
+	}
+	var codes []int
+	for range 3 {
+		r := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		r.Header.Set("Authorization", "Bearer not-a-token")
+		w := httptest.NewRecorder()
+		if _, ok := table.authenticate(w, r, false); ok {
+			t.Fatal("request with a bad token authenticated")
+		}
+		codes = append(codes, w.Code)
+	}
+	want := []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("statuses = %v, want %v", codes, want)
+		}
+	}
+}
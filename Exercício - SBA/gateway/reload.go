@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the configuration file is checked for
+// changes.
+const configPollInterval = 2 * time.Second
+
+// currentRoutes is the routing table in use. Each request loads it once and
+// keeps using that table until it finishes, so a reload never changes the
+// routing of a request already in flight.
+var currentRoutes atomic.Pointer[routeTable]
+
+// reloadMu serializes reloads, which come from both the configuration
+// watcher and the registry watcher.
+var reloadMu sync.Mutex
+
+// reloadRoutes loads the configuration at path, with the instances found in
+// the registry, and swaps it in. On any error the table in use is kept.
+func reloadRoutes(path string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	applyDiscovered(cfg)
+	table, err := newRouteTable(cfg, currentRoutes.Load())
+	if err != nil {
+		return err
+	}
+	table.startHealthChecks()
+	if old := currentRoutes.Swap(table); old != nil {
+		old.stopHealthChecks()
+		// Requests still using the old table keep their connections;
+		// only idle ones are released.
+		old.closeIdleConnections()
+	}
+	return nil
+}
+
+// watchConfig reloads the routing table on SIGHUP and whenever the
+// configuration file changes on disk. It never returns.
+func watchConfig(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			slog.Info("SIGHUP received, reloading configuration")
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil || (last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size()) {
+				continue
+			}
+			last = info
+			slog.Info("configuration changed, reloading", "path", path)
+		}
+
+		if err := reloadRoutes(path); err != nil {
+			slog.Error("configuration rejected, keeping current routes", "error", err)
+			continue
+		}
+		slog.Info("configuration reloaded", "routes", len(currentRoutes.Load().routes))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Retry defaults, used when the route or upstream does not set them.
+const (
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 2 * time.Second
+	defaultBudgetRatio    = 0.2
+	defaultBudgetMinRate  = 2
+)
+
+// maxRetryBody is the largest request body kept in memory so the request
+// can be sent again; bigger requests are never retried.
+const maxRetryBody = 1 << 20
+
+// budgetWindow is the period over which a retry budget is computed.
+const budgetWindow = 10 * time.Second
+
+// isIdempotent reports whether repeating a request with method has the same
+// effect as sending it once (RFC 9110, section 9.2.2).
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// shouldRetry reports whether an attempt that ended with status or err is
+// worth repeating: connection errors, per-attempt timeouts and answers that
+// mean "try again" are; a caller that gave up or an expired route deadline
+// are not.
+func shouldRetry(ctx context.Context, status int, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryPolicy is a route's RetryConfig with the defaults filled in.
+type retryPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func newRetryPolicy(cfg RetryConfig) retryPolicy {
+	p := retryPolicy{
+		maxRetries: cfg.MaxRetries,
+		baseDelay:  time.Duration(cfg.BaseDelay),
+		maxDelay:   time.Duration(cfg.MaxDelay),
+	}
+	if p.baseDelay == 0 {
+		p.baseDelay = defaultRetryBaseDelay
+	}
+	if p.maxDelay == 0 {
+		p.maxDelay = defaultRetryMaxDelay
+	}
+	return p
+}
+
+// backoff returns how long to wait before retry number n (starting at 1):
+// the delay doubles on every retry up to maxDelay, and a random half of it
+// is dropped so that clients retrying together spread out.
+func (p retryPolicy) backoff(n int) time.Duration {
+	delay := p.baseDelay << (n - 1)
+	if delay > p.maxDelay || delay <= 0 {
+		delay = p.maxDelay
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sleepContext waits for d or until ctx is done, reporting whether the full
+// delay elapsed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryBudget caps the retries sent to an upstream to a fraction of its
+// traffic, so that retries cannot multiply the load on a service that is
+// already failing. Over the last budgetWindow, retries may make up ratio of
+// the requests, with minRate retries per second always allowed.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	minRate float64
+	// buckets count requests and retries per second of the window.
+	buckets [10]budgetBucket
+}
+
+type budgetBucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{}
+}
+
+// configure applies cfg, filling in the defaults. Counters are kept.
+func (b *retryBudget) configure(cfg RetryBudgetConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ratio = cfg.Ratio
+	if b.ratio == 0 {
+		b.ratio = defaultBudgetRatio
+	}
+	b.minRate = cfg.MinRetriesPerSecond
+	if b.minRate == 0 {
+		b.minRate = defaultBudgetMinRate
+	}
+}
+
+// bucket returns the counters for the current second. Callers must hold b.mu.
+func (b *retryBudget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	bk := &b.buckets[second%int64(len(b.buckets))]
+	if bk.second != second {
+		*bk = budgetBucket{second: second}
+	}
+	return bk
+}
+
+// recordRequest counts a first attempt.
+func (b *retryBudget) recordRequest() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now()).requests++
+}
+
+// allowRetry reports whether one more retry fits in the budget and, if so,
+// counts it.
+func (b *retryBudget) allowRetry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	requests, retries := 0, 0
+	for _, bk := range b.buckets {
+		if bk.second >= oldest {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	allowed := max(b.ratio*float64(requests), b.minRate*budgetWindow.Seconds())
+	if float64(retries) >= allowed {
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		status int
+		err    error
+		want   bool
+	}{
+		{"ok", context.Background(), http.StatusOK, nil, false},
+		{"client error", context.Background(), http.StatusNotFound, nil, false},
+		{"internal error", context.Background(), http.StatusInternalServerError, nil, false},
+		{"bad gateway", context.Background(), http.StatusBadGateway, nil, true},
+		{"unavailable", context.Background(), http.StatusServiceUnavailable, nil, true},
+		{"gateway timeout", context.Background(), http.StatusGatewayTimeout, nil, true},
+		{"connection error", context.Background(), 0, errors.New("connection refused"), true},
+		{"attempt timed out", context.Background(), 0, context.DeadlineExceeded, true},
+		{"caller gave up", context.Background(), 0, context.Canceled, false},
+		{"request context done", canceled, http.StatusBadGateway, nil, false},
+	}
+	for _, tt := range tests {
+		if got := shouldRetry(tt.ctx, tt.status, tt.err); got != tt.want {
+			t.Errorf("%s: shouldRetry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackoffBounds(t *testing.T) {
+	p := newRetryPolicy(RetryConfig{BaseDelay: Duration(100 * time.Millisecond), MaxDelay: Duration(time.Second)})
+	for n, full := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		70: time.Second, // the shift overflows
+	} {
+		for range 50 {
+			if d := p.backoff(n); d < full/2 || d > full {
+				t.Fatalf("backoff(%d) = %v, want between %v and %v", n, d, full/2, full)
+			}
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      RetryBudgetConfig
+		requests int
+		want     int
+	}{
+		// 0.1 retries per second over the 10s window: one retry.
+		{"floor without traffic", RetryBudgetConfig{Ratio: 0.5, MinRetriesPerSecond: 0.1}, 0, 1},
+		{"ratio of the traffic", RetryBudgetConfig{Ratio: 0.5, MinRetriesPerSecond: 0.1}, 100, 50},
+		{"floor over a small ratio", RetryBudgetConfig{Ratio: 0.01, MinRetriesPerSecond: 2}, 100, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRetryBudget()
+			b.configure(tt.cfg)
+			for range tt.requests {
+				b.recordRequest()
+			}
+			got := 0
+			for b.allowRetry() {
+				got++
+				if got > tt.want {
+					break
+				}
+			}
+			if got != tt.want {
+				t.Errorf("retries allowed = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
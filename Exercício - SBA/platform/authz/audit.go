@@ -0,0 +1,76 @@
+package authz
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Service    string    `json:"service"`
+	Event      string    `json:"event"`
+	Subject    string    `json:"subject,omitempty"`
+	Roles      []string  `json:"roles,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Reason     string    `json:"reason"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+var (
+	auditMu      sync.Mutex
+	auditFile    *os.File
+	auditService string
+)
+
+// OpenAuditLog opens the audit log at path for appending. Its records name
+// service as their source.
+func OpenAuditLog(service, path string) error {
+	auditService = service
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	auditFile = f
+	return nil
+}
+
+// Audit records that the request of c was denied with status for reason.
+func Audit(r *http.Request, c Caller, status int, reason string) {
+	rec := auditRecord{
+		Time:       time.Now().UTC(),
+		Service:    auditService,
+		Event:      "access_denied",
+		Subject:    c.Subject,
+		Roles:      c.Roles,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Status:     status,
+		Reason:     reason,
+		RemoteAddr: r.RemoteAddr,
+	}
+	slog.WarnContext(r.Context(), "access denied", "subject", rec.Subject, "method", rec.Method, "path", rec.Path, "status", status, "reason", reason)
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return
+	}
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		slog.Error("writing audit log", "error", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Package authz decides what the caller of a service request may do, from
+// the identity the gateway verified, and audits the requests it denies.
+package authz
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"platform/httpjson"
+)
+
+// Roles a caller may hold.
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+)
+
+// Headers describing the caller of a service request. The subject and roles
+// are set by the gateway once it has verified the client; a service calling
+// another on its own behalf names itself in HeaderService instead. None of
+// them is believed unless HeaderServiceToken carries the service token.
+const (
+	HeaderSubject      = "X-Auth-Subject"
+	HeaderRoles        = "X-Auth-Roles"
+	HeaderService      = "X-Auth-Service"
+	HeaderServiceToken = "X-Service-Token"
+)
+
+// minServiceTokenLength is the shortest service token accepted.
+const minServiceTokenLength = 32
+
+// serviceToken is the secret shared by the gateway and the services; empty
+// until LoadServiceToken succeeds, which leaves every caller anonymous.
+var serviceToken string
+
+// LoadServiceToken reads the service token from SERVICE_TOKEN. It is
+// required: a request that cannot prove it comes from the gateway or
+// another service has no identity.
+func LoadServiceToken() error {
+	token := os.Getenv("SERVICE_TOKEN")
+	if len(token) < minServiceTokenLength {
+		return fmt.Errorf("SERVICE_TOKEN must hold a secret of at least %d bytes shared by the gateway and the services", minServiceTokenLength)
+	}
+	serviceToken = token
+	return nil
+}
+
+// Vouch marks an outgoing request as coming from inside the system by
+// adding the service token to its headers h. service names the service
+// calling on its own behalf; it is empty when the gateway forwards the
+// request of a client.
+func Vouch(h http.Header, service string) {
+	h.Set(HeaderServiceToken, serviceToken)
+	if service != "" {
+		h.Set(HeaderService, service)
+	} else {
+		h.Del(HeaderService)
+	}
+}
+
+// Caller is who made a request. Its identity comes from the headers above,
+// and only when the request carries the service token: anyone else, and a
+// client the gateway let through without authentication, is anonymous and
+// may do nothing that requires a role or an owner.
+type Caller struct {
+	Subject string
+	Roles   []string
+	// Service names the service making the request on its own behalf.
+	Service string
+}
+
+// From returns the caller of r.
+func From(r *http.Request) Caller {
+	token := r.Header.Get(HeaderServiceToken)
+	if serviceToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(serviceToken)) != 1 {
+		return Caller{}
+	}
+	c := Caller{Subject: r.Header.Get(HeaderSubject), Service: r.Header.Get(HeaderService)}
+	for _, role := range strings.Split(r.Header.Get(HeaderRoles), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			c.Roles = append(c.Roles, role)
+		}
+	}
+	return c
+}
+
+// internal reports whether another service makes the request, which is
+// trusted with every record.
+func (c Caller) internal() bool { return c.Service != "" }
+
+// Has reports whether the caller holds role.
+func (c Caller) Has(role string) bool { return slices.Contains(c.Roles, role) }
+
+// CanReadAll reports whether the caller may read every user's data:
+// support and admin may.
+func (c Caller) CanReadAll() bool {
+	return c.internal() || c.Has(RoleAdmin) || c.Has(RoleSupport)
+}
+
+// CanWriteAll reports whether the caller may change every user's data:
+// only admin may.
+func (c Caller) CanWriteAll() bool {
+	return c.internal() || c.Has(RoleAdmin)
+}
+
+// CanRead reports whether the caller may read data owned by ownerID.
+func (c Caller) CanRead(ownerID string) bool {
+	return c.CanReadAll() || (c.Subject != "" && c.Subject == ownerID)
+}
+
+// CanWrite reports whether the caller may change data owned by ownerID.
+func (c Caller) CanWrite(ownerID string) bool {
+	return c.CanWriteAll() || (c.Subject != "" && c.Subject == ownerID)
+}
+
+// Forbid answers 403 and records the denial in the audit log.
+func Forbid(w http.ResponseWriter, r *http.Request, c Caller, reason string) {
+	Audit(r, c, http.StatusForbidden, reason)
+	httpjson.Error(w, http.StatusForbidden, "Forbidden: "+reason)
+}
@@ -0,0 +1,155 @@
+// Package clientauth finds the gateway and sends it the authenticated
+// requests of the clients, logging in as needed.
+package clientauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Demo credentials used to log in when SBA_EMAIL and SBA_PASSWORD are not set.
+// They work against a users service started with SEED_PASSWORD=senha123.
+const (
+	demoEmail    = "joao@example.com"
+	demoPassword = "senha123"
+)
+
+// DefaultGatewayURL is where the gateway listens in local development.
+const DefaultGatewayURL = "http://localhost:8090"
+
+// FindGateway returns SBA_GATEWAY_URL when it is set, else the address of a
+// gateway listed in the service registry at registry, else the local
+// development address.
+func FindGateway(registry string) string {
+	if u := os.Getenv("SBA_GATEWAY_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	registry = strings.TrimSuffix(registry, "/")
+	if registry == "" {
+		return DefaultGatewayURL
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(registry + "/services/gateway")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Registry unavailable (%v), using %s\n", err, DefaultGatewayURL)
+		return DefaultGatewayURL
+	}
+	defer resp.Body.Close()
+	var instances []struct {
+		Address string `json:"address"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&instances) != nil || len(instances) == 0 {
+		fmt.Fprintf(os.Stderr, "No gateway registered, using %s\n", DefaultGatewayURL)
+		return DefaultGatewayURL
+	}
+	return strings.TrimSuffix(instances[rand.IntN(len(instances))].Address, "/")
+}
+
+// Client sends requests to the gateway at URL on behalf of one user.
+type Client struct {
+	// URL is the gateway's base URL.
+	URL string
+
+	mu sync.Mutex
+	// fixedToken is SBA_TOKEN; when set it is always sent and no login is
+	// attempted.
+	fixedToken string
+	token      string
+	// apiKey is SBA_API_KEY; when set it is sent instead of a bearer token,
+	// for jobs that cannot log in.
+	apiKey string
+}
+
+// New returns the client of the gateway at gateway, with the credentials
+// found in the environment.
+func New(gateway string) *Client {
+	token := os.Getenv("SBA_TOKEN")
+	return &Client{
+		URL:        strings.TrimSuffix(gateway, "/"),
+		fixedToken: token,
+		token:      token,
+		apiKey:     os.Getenv("SBA_API_KEY"),
+	}
+}
+
+// accessToken returns the bearer token to send to the gateway, logging in
+// first when there is none yet or renew is set.
+func (c *Client) accessToken(renew bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fixedToken != "" || (c.token != "" && !renew) {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"email":    envOr("SBA_EMAIL", demoEmail),
+		"password": envOr("SBA_PASSWORD", demoPassword),
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Post(c.URL+"/api/auth/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("login failed: %d %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	c.token = tokens.AccessToken
+	return c.token, nil
+}
+
+// Get sends an authenticated GET for endpoint, a path on the gateway. When
+// the gateway rejects the token (it may have expired), it logs in again and
+// retries once.
+func (c *Client) Get(endpoint string) (*http.Response, error) {
+	url := c.URL + endpoint
+	if c.apiKey != "" {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-API-Key", c.apiKey)
+		return http.DefaultClient.Do(req)
+	}
+	for renew := false; ; renew = true {
+		token, err := c.accessToken(renew)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || renew || c.fixedToken != "" {
+			return resp, err
+		}
+		resp.Body.Close()
+	}
+}
+
+// envOr returns the environment variable key, or fallback when it is unset.
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
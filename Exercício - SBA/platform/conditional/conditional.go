@@ -0,0 +1,99 @@
+// Package conditional implements the ETag validators and conditional
+// requests of RFC 9110 for the services' resources.
+package conditional
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform/httpjson"
+)
+
+// ErrPreconditionFailed is returned by an update whose If-Match does not
+// match the stored resource: someone else changed it in the meantime.
+var ErrPreconditionFailed = errors.New("the resource was changed by another request; fetch it again and retry")
+
+// EntityTag is the ETag of a resource at version, last changed at updated.
+// The time keeps tags unique when a store starting afresh hands out the same
+// ID and version again.
+func EntityTag(version int, updated time.Time) string {
+	return `"` + strconv.Itoa(version) + "-" + strconv.FormatInt(updated.UnixNano(), 36) + `"`
+}
+
+// SetValidators sets the ETag and Last-Modified headers of a response.
+func SetValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// NotModified answers 304 when the conditional headers of r show that the
+// caller already holds the current representation: If-None-Match when sent,
+// If-Modified-Since otherwise (RFC 9110, section 13.2.2).
+func NotModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagListMatches(inm, etag, false) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// RequireIfMatch returns the If-Match header of an update. Updates must say
+// which version they were based on; without it a 428 has been written.
+func RequireIfMatch(w http.ResponseWriter, r *http.Request) (string, bool) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		httpjson.Error(w, http.StatusPreconditionRequired, "If-Match is required: send the ETag of the version being changed")
+		return "", false
+	}
+	return ifMatch, true
+}
+
+// CheckIfMatch returns ErrPreconditionFailed unless the If-Match list
+// matches etag, using strong comparison (RFC 9110, section 13.1.1).
+func CheckIfMatch(ifMatch, etag string) error {
+	if etagListMatches(ifMatch, etag, true) {
+		return nil
+	}
+	return ErrPreconditionFailed
+}
+
+// etagListMatches reports whether a list of entity tags, or "*", matches
+// etag. Weak tags never match under strong comparison.
+func etagListMatches(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// WritePreconditionFailed answers 412 with the ETag of the stored version.
+func WritePreconditionFailed(w http.ResponseWriter, currentETag string) {
+	if currentETag != "" {
+		w.Header().Set("ETag", currentETag)
+	}
+	httpjson.Error(w, http.StatusPreconditionFailed, ErrPreconditionFailed.Error())
+}
@@ -0,0 +1,180 @@
+// Package discovery lists a process in the service registry and keeps it
+// listed for as long as it runs.
+package discovery
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registrationTTL is how long the registry keeps this process listed
+// without a heartbeat; heartbeats are sent three times per TTL.
+const registrationTTL = 30 * time.Second
+
+// HeaderToken carries the registration token on the calls that change the
+// registry.
+const HeaderToken = "X-Registry-Token"
+
+// minTokenLength is the shortest registration token accepted, so that it
+// cannot be guessed.
+const minTokenLength = 32
+
+// errNotRegistered is the registry's answer to a heartbeat from an instance
+// it does not know, after it expired or the registry restarted.
+var errNotRegistered = errors.New("instance not registered")
+
+// Client is the HTTP client for calls to the registry, which answers at
+// once or not at all.
+var Client = &http.Client{Timeout: 2 * time.Second}
+
+// registration is the body of the registry's PUT /services/{service}/{id}.
+type registration struct {
+	Address  string            `json:"address"`
+	Version  string            `json:"version,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	TTL      string            `json:"ttl"`
+}
+
+// ReadToken returns the registration token shared by the registry and the
+// processes it lists, read from REGISTRY_TOKEN.
+func ReadToken() (string, error) {
+	token := os.Getenv("REGISTRY_TOKEN")
+	if len(token) < minTokenLength {
+		return "", fmt.Errorf("REGISTRY_TOKEN must be set to at least %d bytes", minTokenLength)
+	}
+	return token, nil
+}
+
+// Register lists this process in the service registry at registry under
+// service, keeps it listed with heartbeats and returns the function that
+// removes it on shutdown. The address announced is SERVICE_ADDRESS, by
+// default the listen address addr with localhost for a wildcard host; the
+// instance ID is SERVICE_ID, by default the host name and port;
+// SERVICE_METADATA ("key=value,...") is added to metadata. With an empty
+// registry nothing is registered; otherwise the registration token must be
+// set (see ReadToken). The registry being down only delays the
+// registration: it is retried until it succeeds.
+func Register(registry, service, version, addr string, metadata map[string]string) (deregister func(), err error) {
+	base := strings.TrimSuffix(registry, "/")
+	if base == "" {
+		return func() {}, nil
+	}
+	token, err := ReadToken()
+	if err != nil {
+		return nil, err
+	}
+	listenHost, port, _ := net.SplitHostPort(addr)
+	if listenHost == "" || listenHost == "0.0.0.0" || listenHost == "::" {
+		listenHost = "localhost"
+	}
+	hostname, _ := os.Hostname()
+	id := cmp.Or(os.Getenv("SERVICE_ID"), cmp.Or(hostname, "localhost")+"-"+port)
+	reg := registration{
+		Address:  cmp.Or(os.Getenv("SERVICE_ADDRESS"), "http://"+net.JoinHostPort(listenHost, port)),
+		Version:  version,
+		Metadata: maps.Clone(metadata),
+		TTL:      registrationTTL.String(),
+	}
+	for _, kv := range strings.Split(os.Getenv("SERVICE_METADATA"), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.TrimSpace(k) != "" {
+			if reg.Metadata == nil {
+				reg.Metadata = map[string]string{}
+			}
+			reg.Metadata[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	instanceURL := base + "/services/" + url.PathEscape(service) + "/" + url.PathEscape(id)
+	logger := slog.With("registry", base, "instance_id", id)
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(registrationTTL / 3)
+		defer ticker.Stop()
+		registered, failing := false, false
+		for {
+			var err error
+			if registered {
+				err = registryCall(http.MethodPut, instanceURL+"/heartbeat", token, nil)
+				registered = err == nil
+			}
+			if !registered {
+				if err = registryCall(http.MethodPut, instanceURL, token, reg); err == nil {
+					registered = true
+					logger.Info("registered with the service registry", "address", reg.Address)
+				}
+			}
+			switch {
+			case err != nil && !failing:
+				logger.Warn("service registry unavailable, retrying", "error", err)
+			case err == nil && failing:
+				logger.Info("service registry available again")
+			}
+			failing = err != nil
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+			if err := registryCall(http.MethodDelete, instanceURL, token, nil); err != nil && !errors.Is(err, errNotRegistered) {
+				logger.Warn("deregistering from the service registry", "error", err)
+				return
+			}
+			logger.Info("deregistered from the service registry")
+		})
+	}, nil
+}
+
+// registryCall sends one request to the registry with the registration
+// token, with body encoded as JSON when it is not nil.
+func registryCall(method, target, token string, body any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(context.Background(), method, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(HeaderToken, token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotRegistered
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("registry answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Package health serves the /health and /ready endpoints of the services,
+// whose report has the same schema everywhere so the gateway can read any of
+// them.
+package health
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"platform/httpjson"
+)
+
+// startedAt is used to report the uptime.
+var startedAt = time.Now()
+
+// CheckStatus is the result of one readiness check.
+type CheckStatus struct {
+	Status string `json:"status"`
+	Driver string `json:"driver,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report is the body of /health and /ready.
+type Report struct {
+	Status        string                 `json:"status"`
+	Service       string                 `json:"service"`
+	Version       string                 `json:"version"`
+	StartedAt     time.Time              `json:"started_at"`
+	UptimeSeconds float64                `json:"uptime_seconds"`
+	Checks        map[string]CheckStatus `json:"checks"`
+}
+
+// Service describes the service whose health is reported. Checks pings each
+// dependency, by the name it is reported under; every one of them uses the
+// storage named by Driver.
+type Service struct {
+	Name    string
+	Version string
+	Driver  string
+	Checks  map[string]func(context.Context) error
+}
+
+// report runs the checks and reports whether the service can take traffic.
+// The report itself says "ok": the process is alive.
+func (s Service) report(r *http.Request) (Report, bool) {
+	report := Report{
+		Status:        "ok",
+		Service:       s.Name,
+		Version:       s.Version,
+		StartedAt:     startedAt,
+		UptimeSeconds: time.Since(startedAt).Round(time.Millisecond).Seconds(),
+		Checks:        make(map[string]CheckStatus, len(s.Checks)),
+	}
+	ready := true
+	for name, check := range s.Checks {
+		status := CheckStatus{Status: "ok", Driver: s.Driver}
+		if err := check(r.Context()); err != nil {
+			status.Status, status.Error = "unavailable", err.Error()
+			ready = false
+		}
+		report.Checks[name] = status
+	}
+	return report, ready
+}
+
+// Liveness answers 200 as long as the process is able to serve requests;
+// the checks are informative only.
+func (s Service) Liveness(w http.ResponseWriter, r *http.Request) {
+	report, _ := s.report(r)
+	w.Header().Set("Cache-Control", "no-store")
+	httpjson.Write(w, http.StatusOK, report)
+}
+
+// Readiness answers 503 while a dependency such as the storage is not
+// usable, so the gateway stops routing to this instance.
+func (s Service) Readiness(w http.ResponseWriter, r *http.Request) {
+	report, ready := s.report(r)
+	status := http.StatusOK
+	if !ready {
+		report.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	httpjson.Write(w, status, report)
+}
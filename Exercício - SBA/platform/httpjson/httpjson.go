@@ -0,0 +1,20 @@
+// Package httpjson writes the JSON responses of the gateway and the
+// services.
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Write encodes v as the response body with the given status code.
+func Write(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Error sends the JSON error body used by every failing endpoint.
+func Error(w http.ResponseWriter, status int, message string) {
+	Write(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,141 @@
+// Package journal is the append-only storage the services keep their
+// records in when the file storage driver is chosen.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Entry is one line of a storage journal: either the full new state of a
+// record ("put") or the removal of an ID ("delete").
+type Entry[T any] struct {
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	Record *T     `json:"record,omitempty"`
+}
+
+// Journal is an append-only file of JSON lines. Every change is written and
+// synced before it becomes visible, so the file can be replayed after a
+// restart to rebuild the exact state.
+type Journal[T any] struct {
+	path string
+	file *os.File
+}
+
+// Open replays every entry in path through apply and opens the file
+// for appending. existed is false when the file had to be created. A torn
+// last line (from a crash in the middle of a write) is skipped; corruption
+// anywhere else is an error.
+func Open[T any](path string, apply func(Entry[T])) (j *Journal[T], existed bool, err error) {
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, false, err
+		}
+	case err != nil:
+		return nil, false, err
+	default:
+		existed = true
+		lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+		for i, line := range lines {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var entry Entry[T]
+			if err := json.Unmarshal(line, &entry); err != nil {
+				if i == len(lines)-1 {
+					slog.Warn("skipping incomplete last journal entry", "path", path, "error", err)
+					break
+				}
+				return nil, false, fmt.Errorf("%s line %d: %w", path, i+1, err)
+			}
+			apply(entry)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	return &Journal[T]{path: path, file: file}, existed, nil
+}
+
+// Append durably records one change.
+func (j *Journal[T]) Append(entry Entry[T]) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Compact replaces the journal with one put per current record, so the file
+// does not keep growing with the history of every change.
+func (j *Journal[T]) Compact(entries []Entry[T]) error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return err
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+// Check verifies that the journal file is still the one being written to.
+func (j *Journal[T]) Check() error {
+	onDisk, err := os.Stat(j.path)
+	if err != nil {
+		return err
+	}
+	open, err := j.file.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(onDisk, open) {
+		return fmt.Errorf("%s was replaced or removed", j.path)
+	}
+	return nil
+}
+
+// Close closes the underlying file.
+func (j *Journal[T]) Close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,106 @@
+// Package server is the command-line and HTTP server setup shared by every
+// binary: flags that default to environment variables, server timeouts and
+// graceful shutdown.
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// envErrors collects the environment variables holding invalid values.
+var envErrors []error
+
+// EnvString defines a string flag whose default is the environment variable
+// key, or fallback when it is unset.
+func EnvString(name, key, fallback, usage string) *string {
+	return flag.String(name, cmp.Or(os.Getenv(key), fallback), usage+" (env "+key+")")
+}
+
+// EnvDuration defines a duration flag whose default is the environment
+// variable key, or fallback when it is unset.
+func EnvDuration(name, key string, fallback time.Duration, usage string) *time.Duration {
+	if s := os.Getenv(key); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			envErrors = append(envErrors, fmt.Errorf("invalid %s %q: %w", key, s, err))
+		} else {
+			fallback = d
+		}
+	}
+	return flag.Duration(name, fallback, usage+" (env "+key+")")
+}
+
+// ParseFlags parses the command line and returns the errors found in the
+// environment variables the flags default to.
+func ParseFlags() error {
+	flag.Parse()
+	return errors.Join(envErrors...)
+}
+
+// Flags are the settings of the HTTP server common to every binary.
+type Flags struct {
+	Addr                                   *string
+	ReadTimeout, WriteTimeout, IdleTimeout *time.Duration
+	ShutdownTimeout                        *time.Duration
+}
+
+// DefineFlags defines the server flags, listening on addr by default.
+func DefineFlags(addr string) Flags {
+	return Flags{
+		Addr:            EnvString("addr", "LISTEN_ADDR", addr, "address to listen on"),
+		ReadTimeout:     EnvDuration("read-timeout", "READ_TIMEOUT", 30*time.Second, "maximum time to read a request"),
+		WriteTimeout:    EnvDuration("write-timeout", "WRITE_TIMEOUT", 60*time.Second, "maximum time to write a response"),
+		IdleTimeout:     EnvDuration("idle-timeout", "IDLE_TIMEOUT", 2*time.Minute, "how long idle keep-alive connections are kept"),
+		ShutdownTimeout: EnvDuration("shutdown-timeout", "SHUTDOWN_TIMEOUT", 20*time.Second, "how long requests in flight may take to finish on shutdown"),
+	}
+}
+
+// Server returns the HTTP server for handler.
+func (f Flags) Server(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              *f.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: min(*f.ReadTimeout, 10*time.Second),
+		ReadTimeout:       *f.ReadTimeout,
+		WriteTimeout:      *f.WriteTimeout,
+		IdleTimeout:       *f.IdleTimeout,
+	}
+}
+
+// Serve runs srv until the process receives SIGINT or SIGTERM. It then calls
+// beforeDrain, stops accepting connections and waits for the requests in
+// flight to finish, for at most drainTimeout; those still running then are
+// cut off. The error returned is the one that kept the server from running.
+func Serve(srv *http.Server, drainTimeout time.Duration, beforeDrain func()) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		slog.Info("shutting down", "signal", s.String(), "drain_timeout", drainTimeout.String())
+	}
+
+	beforeDrain()
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("requests still in flight after the drain timeout, closing their connections", "error", err)
+		srv.Close()
+	}
+	return nil
+}
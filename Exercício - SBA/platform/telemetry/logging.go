@@ -0,0 +1,145 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// HeaderRequestID carries the ID that ties together the log lines written
+// for one request by the gateway and every service it reaches.
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength bounds the request IDs accepted from callers.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID of the request handled under ctx, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// InitLogging makes slog's default logger write one JSON object per line to
+// stderr, tagged with service and filtered at level (debug, info, warn or
+// error; info when empty). Lines logged with a request's context also carry
+// its request ID and trace IDs. The log package is redirected to the same
+// logger.
+func InitLogging(service, level string) error {
+	var minLevel slog.Level
+	if level != "" {
+		if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	h := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: minLevel})
+	slog.SetDefault(slog.New(contextHandler{h}).With("service", service))
+	return nil
+}
+
+// Fatal logs msg at error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request and trace IDs found in the context of
+// each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestIDFrom(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	if s := SpanFrom(ctx); s != nil {
+		rec.AddAttrs(
+			slog.String("trace_id", hex.EncodeToString(s.sc.traceID[:])),
+			slog.String("span_id", hex.EncodeToString(s.sc.spanID[:])))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// validRequestID reports whether a caller-supplied request ID is safe to
+// log and forward: short, and made of letters, digits and ".-_:".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune(".-_:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns 32 random hex digits.
+func newRequestID() string {
+	var b [16]byte
+	putRandom(b[:8])
+	putRandom(b[8:])
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID gives every request an ID: the X-Request-ID sent by the
+// caller when it is valid, or a new one. The ID is kept in the request
+// context and headers, so it is forwarded upstream, and echoed in the
+// response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		r.Header.Set(HeaderRequestID, id)
+		w.Header().Set(HeaderRequestID, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// PropagateRequestID sets the request ID of ctx on an outgoing request.
+func PropagateRequestID(ctx context.Context, h http.Header) {
+	if id := requestIDFrom(ctx); id != "" {
+		h.Set(HeaderRequestID, id)
+	}
+}
+
+// accessLog writes one line per request handled by next with its method,
+// path, status, response size and duration. Health probes are logged at
+// debug level, as they arrive every few seconds.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		level := slog.LevelInfo
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" {
+			level = slog.LevelDebug
+		}
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("query", r.URL.RawQuery),
+			slog.Int("status", rec.statusCode()),
+			slog.Int64("bytes", rec.written),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr))
+	})
+}
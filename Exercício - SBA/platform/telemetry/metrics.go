@@ -0,0 +1,315 @@
+package telemetry
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency
+// histograms; the same as the Prometheus client libraries use.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is one metric family written by /metrics.
+type collector interface {
+	writeTo(w *bufio.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []collector
+)
+
+func register(c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, c)
+}
+
+// family holds what every metric type shares: its name, help text, label
+// names and one series per distinct combination of label values.
+type family[T any] struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	series map[string]*T
+}
+
+// get returns the series for values, creating it with init when new.
+func (f *family[T]) get(values []string, init func() *T) *T {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", f.name, len(values), len(f.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.series[key]
+	if s == nil {
+		s = init()
+		f.series[key] = s
+	}
+	return s
+}
+
+// each calls fn for every series in a stable order. Callers must hold f.mu.
+func (f *family[T]) each(fn func(values []string, s *T)) {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		var values []string
+		if len(f.labels) > 0 {
+			values = strings.Split(key, "\xff")
+		}
+		fn(values, f.series[key])
+	}
+}
+
+func (f *family[T]) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+}
+
+// CounterVec is a counter, or a gauge, partitioned by labels.
+type CounterVec struct {
+	family[float64]
+}
+
+// NewCounter registers a counter family served by ServeMetrics.
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	return newValueVec(name, help, "counter", labels)
+}
+
+// NewGauge registers a gauge family served by ServeMetrics.
+func NewGauge(name, help string, labels ...string) *CounterVec {
+	return newValueVec(name, help, "gauge", labels)
+}
+
+func newValueVec(name, help, kind string, labels []string) *CounterVec {
+	c := &CounterVec{family[float64]{name: name, help: help, kind: kind, labels: labels, series: map[string]*float64{}}}
+	register(c)
+	return c
+}
+
+// Add adds v to the series with the label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	s := c.get(values, func() *float64 { return new(float64) })
+	c.mu.Lock()
+	*s += v
+	c.mu.Unlock()
+}
+
+// Inc adds one to the series with the label values.
+func (c *CounterVec) Inc(values ...string) { c.Add(1, values...) }
+
+func (c *CounterVec) writeTo(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	c.each(func(values []string, v *float64) {
+		writeSample(w, c.name, c.labels, values, "", "", *v)
+	})
+}
+
+// histogram is one series of a HistogramVec.
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	family[histogram]
+	buckets []float64
+}
+
+// NewHistogram registers a histogram family with the given bucket upper
+// bounds, served by ServeMetrics.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{family[histogram]{name: name, help: help, kind: "histogram", labels: labels, series: map[string]*histogram{}}, buckets}
+	register(h)
+	return h
+}
+
+// Observe records v in the series with the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	s := h.get(values, func() *histogram { return &histogram{counts: make([]uint64, len(h.buckets))} })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Since observes the seconds elapsed since start.
+func (h *HistogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) writeTo(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	h.each(func(values []string, s *histogram) {
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, values, "le", formatFloat(le), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, values, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, values, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, values, "", "", float64(s.count))
+	})
+}
+
+// collectedVec is read at scrape time by calling collect, for values that
+// are cheaper to compute on demand than to keep up to date.
+type collectedVec struct {
+	name, help, kind string
+	labels           []string
+	collect          func(emit func(v float64, values ...string))
+}
+
+// NewCollected registers a family of the given kind whose samples collect
+// emits at every scrape.
+func NewCollected(name, help, kind string, labels []string, collect func(emit func(v float64, values ...string))) {
+	register(&collectedVec{name: name, help: help, kind: kind, labels: labels, collect: collect})
+}
+
+func (c *collectedVec) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, escapeHelp(c.help), c.name, c.kind)
+	c.collect(func(v float64, values ...string) {
+		writeSample(w, c.name, c.labels, values, "", "", v)
+	})
+}
+
+// writeSample writes one line of the text exposition format, with an
+// optional extra label such as a histogram's "le".
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extra, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// ServeMetrics handles GET /metrics in the Prometheus text format.
+func ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	registryMu.Lock()
+	collectors := slices.Clone(registry)
+	registryMu.Unlock()
+	for _, c := range collectors {
+		c.writeTo(bw)
+	}
+	bw.Flush()
+}
+
+// MethodLabel keeps the method label bounded: methods outside RFC 9110 are
+// counted as "OTHER".
+func MethodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// StatusClass groups status codes as "2xx", "4xx" and so on.
+func StatusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// HTTP server metrics, recorded by measured.
+var (
+	httpRequests = NewCounter("http_requests_total",
+		"HTTP requests handled, by route, method and status class.", "route", "method", "status_class")
+	httpDuration = NewHistogram("http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route and method.", DefaultBuckets, "route", "method")
+	httpInFlight = NewGauge("http_requests_in_flight",
+		"HTTP requests being handled.")
+)
+
+type metricsRouteKey struct{}
+
+// SetMetricsRoute names the route of the request handled under ctx, for a
+// handler that knows better than the pattern ServeMux matched.
+func SetMetricsRoute(ctx context.Context, route string) {
+	if p, ok := ctx.Value(metricsRouteKey{}).(*string); ok {
+		*p = route
+	}
+}
+
+// measured records the count, latency and status of the requests handled
+// by next. The route label is the pattern ServeMux matched, so the number
+// of series stays bounded whatever paths clients ask for. It must wrap the
+// ServeMux directly: the pattern is copied back to the incoming request for
+// the middleware further out.
+func measured(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpInFlight.Add(1)
+		defer httpInFlight.Add(-1)
+
+		route := new(string)
+		rec := &statusRecorder{ResponseWriter: w}
+		inner := r.WithContext(context.WithValue(r.Context(), metricsRouteKey{}, route))
+		next.ServeHTTP(rec, inner)
+		r.Pattern = inner.Pattern
+
+		if *route == "" {
+			*route = cmp.Or(r.Pattern, "unmatched")
+		}
+		method := MethodLabel(r.Method)
+		httpRequests.Inc(*route, method, StatusClass(rec.statusCode()))
+		httpDuration.Since(start, *route, method)
+	})
+}
@@ -0,0 +1,12 @@
+// Package telemetry is the tracing, logging and metrics shared by the
+// gateway and the services: W3C trace context propagation with span export,
+// JSON logs tagged with request and trace IDs, and Prometheus metrics.
+package telemetry
+
+import "net/http"
+
+// Handler wraps the ServeMux mux of a binary so that every request gets a
+// request ID, a server span, an access log line and its metrics.
+func Handler(mux *http.ServeMux) http.Handler {
+	return withRequestID(traced(accessLog(measured(mux))))
+}
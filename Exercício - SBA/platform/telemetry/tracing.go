@@ -0,0 +1,511 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds, numbered as in OTLP.
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// Trace export batching: spans are sent every traceFlushInterval or as soon
+// as traceBatchSize are waiting. When the exporter falls behind and
+// traceQueueSize spans are queued, new spans are dropped.
+const (
+	traceFlushInterval = 2 * time.Second
+	traceBatchSize     = 256
+	traceQueueSize     = 4096
+)
+
+// spanContext is the part of a span that crosses process boundaries in the
+// W3C traceparent and tracestate headers.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+	state   string
+}
+
+// parseTraceparent reads a traceparent header (W3C Trace Context, level 1).
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	// Later versions may append fields; version 00 has exactly four.
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags&1 == 1
+	return sc, true
+}
+
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// Span is one timed operation of a trace.
+type Span struct {
+	sc       spanContext
+	parentID [8]byte
+	kind     int
+	start    time.Time
+
+	mu   sync.Mutex
+	name string
+	// named is set once a handler chose the name, which traced then keeps.
+	named      bool
+	end        time.Time
+	attributes map[string]any
+	failed     bool
+	message    string
+}
+
+type spanKey struct{}
+
+// SpanFrom returns the span in progress for ctx, or nil.
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// StartSpan starts a span as a child of the span in ctx, or as the root of
+// a new trace when ctx has none. End it with Finish.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	return startSpan(ctx, name, kind, nil)
+}
+
+// startSpan is StartSpan continuing the trace of parent when ctx has no
+// span and parent is valid.
+func startSpan(ctx context.Context, name string, kind int, parent *spanContext) (context.Context, *Span) {
+	s := &Span{name: name, kind: kind, start: time.Now(), attributes: map[string]any{}}
+	switch p := SpanFrom(ctx); {
+	case p != nil:
+		s.sc.traceID, s.sc.sampled, s.sc.state, s.parentID = p.sc.traceID, p.sc.sampled, p.sc.state, p.sc.spanID
+	case parent != nil:
+		s.sc.traceID, s.sc.sampled, s.sc.state, s.parentID = parent.traceID, parent.sampled, parent.state, parent.spanID
+	default:
+		putRandom(s.sc.traceID[:8])
+		putRandom(s.sc.traceID[8:])
+		s.sc.sampled = true
+	}
+	putRandom(s.sc.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// putRandom fills an 8-byte ID with a non-zero random value.
+func putRandom(b []byte) {
+	v := rand.Uint64() | 1
+	for i := range b {
+		b[i] = byte(v >> (8 * i))
+	}
+}
+
+// SetName renames the span. A server span keeps a name set this way rather
+// than taking the route pattern as its name.
+func (s *Span) SetName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name, s.named = name, true
+}
+
+// SetAttribute records a key-value pair describing the operation.
+func (s *Span) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// Fail marks the span as failed. A nil err is ignored, so Fail can be
+// called with the result of the traced operation.
+func (s *Span) Fail(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed, s.message = true, err.Error()
+}
+
+// Finish ends the span and queues it for export if its trace is sampled.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sc.sampled && traceQueue != nil {
+		select {
+		case traceQueue <- s:
+		default:
+		}
+	}
+}
+
+// InjectTrace sets the trace headers of an outgoing request so that the
+// receiver continues the trace of ctx.
+func InjectTrace(ctx context.Context, h http.Header) {
+	s := SpanFrom(ctx)
+	if s == nil {
+		return
+	}
+	h.Set("traceparent", s.sc.traceparent())
+	if s.sc.state != "" {
+		h.Set("tracestate", s.sc.state)
+	} else {
+		h.Del("tracestate")
+	}
+}
+
+// TraceStorage runs a storage call in an internal span named name, with
+// system (the storage driver) as its db.system, when ctx belongs to a traced
+// request. Not finding a record is an answer, not a failure, so an error
+// matching notFound does not mark the span as failed.
+func TraceStorage[T any](ctx context.Context, name, system string, notFound error, call func(context.Context) (T, error)) (T, error) {
+	if SpanFrom(ctx) == nil {
+		return call(ctx)
+	}
+	ctx, s := StartSpan(ctx, name, SpanKindInternal)
+	s.SetAttribute("db.system", system)
+	v, err := call(ctx)
+	if !errors.Is(err, notFound) {
+		s.Fail(err)
+	}
+	s.Finish()
+	return v, err
+}
+
+// TraceStorageErr is TraceStorage for calls that only return an error.
+func TraceStorageErr(ctx context.Context, name, system string, notFound error, call func(context.Context) error) error {
+	_, err := TraceStorage(ctx, name, system, notFound, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, call(ctx)
+	})
+	return err
+}
+
+// traced records a server span for every request handled by next,
+// continuing the trace of the caller when it sent a valid traceparent.
+// Health probes are not traced.
+func traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var parent *spanContext
+		if sc, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			sc.state = r.Header.Get("tracestate")
+			parent = &sc
+		}
+		ctx, s := startSpan(r.Context(), r.Method+" "+r.URL.Path, SpanKindServer, parent)
+		s.SetAttribute("http.request.method", r.Method)
+		s.SetAttribute("url.path", r.URL.Path)
+		if r.URL.RawQuery != "" {
+			s.SetAttribute("url.query", r.URL.RawQuery)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(rec, r)
+
+		// ServeMux records the pattern it matched on the request.
+		s.mu.Lock()
+		if r.Pattern != "" && !s.named {
+			s.name = r.Pattern
+			if !strings.Contains(r.Pattern, " ") {
+				s.name = r.Method + " " + r.Pattern
+			}
+		}
+		s.mu.Unlock()
+		status := rec.statusCode()
+		s.SetAttribute("http.response.status_code", status)
+		if status >= 500 {
+			s.Fail(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+		s.Finish()
+	})
+}
+
+// statusRecorder remembers the status code and body size written through
+// it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter { return rec.ResponseWriter }
+
+func (rec *statusRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+var (
+	// traceQueue holds the finished spans waiting for export; nil when
+	// export is off.
+	traceQueue chan *Span
+	// traceService names this process in exported spans.
+	traceService string
+)
+
+// spanExporter sends finished spans somewhere.
+type spanExporter func(spans []*Span) error
+
+// InitTracing sets up span export as chosen by TRACE_EXPORTER: "otlp" posts
+// OTLP/HTTP JSON to OTEL_EXPORTER_OTLP_ENDPOINT (http://localhost:4318 by
+// default), "file" appends one JSON object per span to TRACE_FILE
+// (data/traces.jsonl by default), and "none", the default, exports nothing
+// while still propagating trace context. The returned function flushes the
+// spans still queued.
+func InitTracing(service string) (flush func(), err error) {
+	traceService = service
+	var export spanExporter
+	switch kind := os.Getenv("TRACE_EXPORTER"); kind {
+	case "", "none":
+		return func() {}, nil
+	case "otlp":
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "http://localhost:4318"
+		}
+		export = otlpExporter(strings.TrimSuffix(endpoint, "/") + "/v1/traces")
+	case "file":
+		path := os.Getenv("TRACE_FILE")
+		if path == "" {
+			path = "data/traces.jsonl"
+		}
+		if export, err = fileExporter(path); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown TRACE_EXPORTER %q (want none, otlp or file)", kind)
+	}
+
+	traceQueue = make(chan *Span, traceQueueSize)
+	flushed := make(chan chan struct{})
+	go func() {
+		ticker := time.NewTicker(traceFlushInterval)
+		defer ticker.Stop()
+		var batch []*Span
+		send := func() {
+			if len(batch) == 0 {
+				return
+			}
+			if err := export(batch); err != nil {
+				slog.Error("exporting spans", "spans", len(batch), "error", err)
+			}
+			batch = nil
+		}
+		for {
+			select {
+			case s := <-traceQueue:
+				if batch = append(batch, s); len(batch) >= traceBatchSize {
+					send()
+				}
+			case <-ticker.C:
+				send()
+			case done := <-flushed:
+				for len(traceQueue) > 0 {
+					batch = append(batch, <-traceQueue)
+				}
+				send()
+				close(done)
+			}
+		}
+	}()
+	return func() {
+		done := make(chan struct{})
+		flushed <- done
+		<-done
+	}, nil
+}
+
+// otlpExporter posts spans to an OTLP/HTTP collector using the JSON
+// encoding.
+func otlpExporter(url string) spanExporter {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(spans []*Span) error {
+		body, err := json.Marshal(otlpRequest(spans))
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("collector answered %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// otlpRequest builds an ExportTraceServiceRequest in its JSON form.
+func otlpRequest(spans []*Span) map[string]any {
+	out := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		attrs := make([]map[string]any, 0, len(s.attributes))
+		for key, value := range s.attributes {
+			attrs = append(attrs, map[string]any{"key": key, "value": otlpValue(value)})
+		}
+		status := map[string]any{"code": 1}
+		if s.failed {
+			status = map[string]any{"code": 2, "message": s.message}
+		}
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.sc.traceID[:]),
+			"spanId":            hex.EncodeToString(s.sc.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+			"status":            status,
+		}
+		if s.sc.state != "" {
+			o["traceState"] = s.sc.state
+		}
+		if s.parentID != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []any{
+				map[string]any{"key": "service.name", "value": otlpValue(traceService)},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "sba"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+// otlpValue wraps a value as an OTLP AnyValue.
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+// fileSpan is how the file exporter writes a span.
+type fileSpan struct {
+	TraceID      string         `json:"trace_id"`
+	SpanID       string         `json:"span_id"`
+	ParentSpanID string         `json:"parent_span_id,omitempty"`
+	Service      string         `json:"service"`
+	Name         string         `json:"name"`
+	Kind         string         `json:"kind"`
+	Start        time.Time      `json:"start"`
+	DurationMS   float64        `json:"duration_ms"`
+	Attributes   map[string]any `json:"attributes,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// fileExporter appends spans to the file at path, one JSON object per line.
+func fileExporter(path string) (spanExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	kinds := map[int]string{SpanKindInternal: "internal", SpanKindServer: "server", SpanKindClient: "client"}
+	return func(spans []*Span) error {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, s := range spans {
+			s.mu.Lock()
+			fs := fileSpan{
+				TraceID:    hex.EncodeToString(s.sc.traceID[:]),
+				SpanID:     hex.EncodeToString(s.sc.spanID[:]),
+				Service:    traceService,
+				Name:       s.name,
+				Kind:       kinds[s.kind],
+				Start:      s.start.UTC(),
+				DurationMS: float64(s.end.Sub(s.start).Microseconds()) / 1000,
+				Attributes: s.attributes,
+				Error:      s.message,
+			}
+			if s.parentID != [8]byte{} {
+				fs.ParentSpanID = hex.EncodeToString(s.parentID[:])
+			}
+			err := enc.Encode(fs)
+			s.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		_, err := f.Write(buf.Bytes())
+		return err
+	}, nil
+}
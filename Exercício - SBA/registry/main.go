@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"platform/discovery"
+	"platform/server"
+)
+
+// Duration is a time.Duration written in JSON as a string like "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var services = newRegistry()
+
+// writeJSON encodes v as the response body with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends the JSON error body used by every failing endpoint.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// pathNames returns the service and instance ID of the request path, or
+// writes a 400 when they are not valid names.
+func pathNames(w http.ResponseWriter, r *http.Request) (service, id string, ok bool) {
+	service, id = r.PathValue("service"), r.PathValue("id")
+	if !validName.MatchString(service) || (id != "" && !validName.MatchString(id)) {
+		writeError(w, http.StatusBadRequest, "service names and instance IDs use letters, digits and . _ - (at most 64)")
+		return "", "", false
+	}
+	return service, id, true
+}
+
+// requireToken lets through only the requests carrying the registration
+// token, so that nobody else can list an address as one of the services or
+// remove their instances. Others get a 401.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(discovery.HeaderToken)), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "a valid "+discovery.HeaderToken+" header is required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// registerInstance handles PUT /services/{service}/{id}. Registering again
+// replaces the instance, so a process that finds itself forgotten simply
+// repeats the call.
+func registerInstance(w http.ResponseWriter, r *http.Request) {
+	service, id, ok := pathNames(w, r)
+	if !ok {
+		return
+	}
+	var reg Registration
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&reg); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if fields := reg.validate(); len(fields) > 0 {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]any{
+			"error":  "validation failed",
+			"fields": fields,
+		})
+		return
+	}
+	in, created := services.register(service, id, reg, time.Now())
+	if created {
+		slog.Info("instance registered", "instance_service", service, "instance_id", id, "address", in.Address, "version", in.Version)
+		writeJSON(w, http.StatusCreated, in)
+		return
+	}
+	writeJSON(w, http.StatusOK, in)
+}
+
+// heartbeat handles PUT /services/{service}/{id}/heartbeat. A 404 tells the
+// instance it expired and must register again.
+func heartbeat(w http.ResponseWriter, r *http.Request) {
+	service, id, ok := pathNames(w, r)
+	if !ok {
+		return
+	}
+	in, err := services.heartbeat(service, id, time.Now())
+	if errors.Is(err, errUnknownInstance) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, in)
+}
+
+// deregisterInstance handles DELETE /services/{service}/{id}.
+func deregisterInstance(w http.ResponseWriter, r *http.Request) {
+	service, id, ok := pathNames(w, r)
+	if !ok {
+		return
+	}
+	if !services.deregister(service, id) {
+		writeError(w, http.StatusNotFound, errUnknownInstance.Error())
+		return
+	}
+	slog.Info("instance deregistered", "instance_service", service, "instance_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listServices handles GET /services: the live instances of every service.
+func listServices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, services.all(time.Now()))
+}
+
+// listInstances handles GET /services/{service}. An unknown service has no
+// instances, which is not an error.
+func listInstances(w http.ResponseWriter, r *http.Request) {
+	service, _, ok := pathNames(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, services.instances(service, time.Now()))
+}
+
+func health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "service": "registry"})
+}
+
+func main() {
+	srvFlags := server.DefineFlags(":8500")
+	logLevel := server.EnvString("log-level", "LOG_LEVEL", "info", "debug, info, warn or error")
+	flagErr := server.ParseFlags()
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		flagErr = errors.Join(flagErr, fmt.Errorf("invalid log level %q", *logLevel))
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})).With("service", "registry"))
+	if flagErr != nil {
+		slog.Error("invalid settings", "error", flagErr)
+		os.Exit(1)
+	}
+	token, err := discovery.ReadToken()
+	if err != nil {
+		slog.Error("reading the registration token", "error", err)
+		os.Exit(1)
+	}
+
+	go services.sweep()
+
+	http.HandleFunc("GET /services", listServices)
+	http.HandleFunc("GET /services/{service}", listInstances)
+	http.HandleFunc("PUT /services/{service}/{id}", requireToken(token, registerInstance))
+	http.HandleFunc("PUT /services/{service}/{id}/heartbeat", requireToken(token, heartbeat))
+	http.HandleFunc("DELETE /services/{service}/{id}", requireToken(token, deregisterInstance))
+	http.HandleFunc("GET /health", health)
+
+	slog.Info("started", "addr", *srvFlags.Addr)
+	if err := server.Serve(srvFlags.Server(http.DefaultServeMux), *srvFlags.ShutdownTimeout, func() {}); err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("stopped")
+}
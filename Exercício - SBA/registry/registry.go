@@ -0,0 +1,181 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Registration TTL bounds: an instance that sends no heartbeat within its
+// TTL is dropped.
+const (
+	defaultTTL = 30 * time.Second
+	minTTL     = 5 * time.Second
+	maxTTL     = 10 * time.Minute
+)
+
+// sweepInterval is how often expired instances are removed.
+const sweepInterval = time.Second
+
+var errUnknownInstance = errors.New("instance not registered")
+
+// validName matches service names and instance IDs, which appear in URLs.
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Instance is one registered process of a service.
+type Instance struct {
+	ID            string            `json:"id"`
+	Service       string            `json:"service"`
+	Address       string            `json:"address"`
+	Version       string            `json:"version,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	TTL           Duration          `json:"ttl"`
+	RegisteredAt  time.Time         `json:"registered_at"`
+	LastHeartbeat time.Time         `json:"last_heartbeat"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+}
+
+// Registration is the body of PUT /services/{service}/{id}.
+type Registration struct {
+	Address  string            `json:"address"`
+	Version  string            `json:"version,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// TTL defaults to 30s.
+	TTL Duration `json:"ttl,omitempty"`
+}
+
+// validate returns the fields of reg that are missing or invalid.
+func (reg Registration) validate() map[string]string {
+	fields := map[string]string{}
+	if u, err := url.Parse(reg.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fields["address"] = "address must be an absolute http or https URL"
+	}
+	if ttl := time.Duration(reg.TTL); ttl != 0 && (ttl < minTTL || ttl > maxTTL) {
+		fields["ttl"] = fmt.Sprintf("ttl must be between %s and %s", minTTL, maxTTL)
+	}
+	return fields
+}
+
+// registry holds the live instances of every service in memory. Instances
+// re-register when they find it restarted, so nothing needs to be persisted.
+type registry struct {
+	mu       sync.Mutex
+	services map[string]map[string]*Instance
+}
+
+func newRegistry() *registry {
+	return &registry{services: map[string]map[string]*Instance{}}
+}
+
+// register adds or replaces the instance id of service.
+func (r *registry) register(service, id string, reg Registration, now time.Time) (Instance, bool) {
+	ttl := cmp.Or(time.Duration(reg.TTL), defaultTTL)
+	in := &Instance{
+		ID:            id,
+		Service:       service,
+		Address:       reg.Address,
+		Version:       reg.Version,
+		Metadata:      reg.Metadata,
+		TTL:           Duration(ttl),
+		RegisteredAt:  now,
+		LastHeartbeat: now,
+		ExpiresAt:     now.Add(ttl),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	instances := r.services[service]
+	if instances == nil {
+		instances = map[string]*Instance{}
+		r.services[service] = instances
+	}
+	_, existed := instances[id]
+	instances[id] = in
+	return *in, !existed
+}
+
+// heartbeat extends the life of a registered instance by its TTL.
+func (r *registry) heartbeat(service, id string, now time.Time) (Instance, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	in := r.services[service][id]
+	if in == nil || !now.Before(in.ExpiresAt) {
+		return Instance{}, errUnknownInstance
+	}
+	in.LastHeartbeat = now
+	in.ExpiresAt = now.Add(time.Duration(in.TTL))
+	return *in, nil
+}
+
+// deregister removes an instance. It reports whether it was registered.
+func (r *registry) deregister(service, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.services[service][id]; !ok {
+		return false
+	}
+	delete(r.services[service], id)
+	if len(r.services[service]) == 0 {
+		delete(r.services, service)
+	}
+	return true
+}
+
+// instances returns the live instances of service, ordered by ID.
+func (r *registry) instances(service string, now time.Time) []Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.live(service, now)
+}
+
+// all returns the live instances of every service.
+func (r *registry) all(now time.Time) map[string][]Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := map[string][]Instance{}
+	for service := range r.services {
+		if live := r.live(service, now); len(live) > 0 {
+			out[service] = live
+		}
+	}
+	return out
+}
+
+// live lists the unexpired instances of service. r.mu must be held.
+func (r *registry) live(service string, now time.Time) []Instance {
+	instances := r.services[service]
+	out := []Instance{}
+	for _, id := range slices.Sorted(maps.Keys(instances)) {
+		if in := instances[id]; now.Before(in.ExpiresAt) {
+			out = append(out, *in)
+		}
+	}
+	return out
+}
+
+// sweep removes the instances whose TTL ran out. It never returns.
+func (r *registry) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.mu.Lock()
+		for service, instances := range r.services {
+			for id, in := range instances {
+				if !now.Before(in.ExpiresAt) {
+					delete(instances, id)
+					slog.Warn("instance expired", "instance_service", service, "instance_id", id, "address", in.Address)
+				}
+			}
+			if len(instances) == 0 {
+				delete(r.services, service)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
@@ -1,11 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
+	"log/slog"
+	"maps"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
+
+	"platform/authz"
+	"platform/conditional"
+	"platform/discovery"
+	"platform/health"
+	"platform/httpjson"
+	"platform/server"
+	"platform/telemetry"
+)
+
+// serviceName and serviceVersion are reported by /health and /ready and
+// announced to the registry.
+const (
+	serviceName    = "billing"
+	serviceVersion = "1.0.0"
 )
 
 type Invoice struct {
@@ -15,56 +35,245 @@ type Invoice struct {
 	Amount      float64   `json:"amount"`
 	Status      string    `json:"status"`
 	PaymentDate time.Time `json:"payment_date"`
+	// Version counts the changes made to the invoice and, with UpdatedAt,
+	// forms its ETag; both are maintained by the repository.
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-var invoices = []Invoice{
-	{ID: "INV-001", UserID: "1", OrderID: "1001", Amount: 3500.00, Status: "paid", PaymentDate: time.Now().AddDate(0, 0, -10)},
-	{ID: "INV-002", UserID: "2", OrderID: "1002", Amount: 100.00, Status: "pending", PaymentDate: time.Time{}},
-	{ID: "INV-003", UserID: "1", OrderID: "1003", Amount: 250.00, Status: "paid", PaymentDate: time.Now().AddDate(0, 0, -2)},
+// etag is the entity tag of the invoice's current version.
+func (inv Invoice) etag() string { return conditional.EntityTag(inv.Version, inv.UpdatedAt) }
+
+// invoiceRequest is the body accepted by POST /invoices, sent by the orders
+// service whenever an order is placed.
+type invoiceRequest struct {
+	OrderID string  `json:"order_id"`
+	UserID  string  `json:"user_id"`
+	Amount  float64 `json:"amount"`
+}
+
+// invoiceRepo holds every invoice; it is chosen at startup by
+// openInvoiceRepository.
+var invoiceRepo InvoiceRepository
+
+// writeStoreError maps repository errors to responses.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrNotFound) {
+		httpjson.Error(w, http.StatusNotFound, "Invoice not found")
+		return
+	}
+	slog.ErrorContext(r.Context(), "storage error", "error", err)
+	httpjson.Error(w, http.StatusInternalServerError, "storage error")
 }
 
 func getInvoices(w http.ResponseWriter, r *http.Request) {
-	log.Println("[BILLING SERVICE] GET /invoices")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(invoices)
+	if c := authz.From(r); !c.CanReadAll() {
+		authz.Forbid(w, r, c, "only support and admin may list every invoice")
+		return
+	}
+	invoices, err := invoiceRepo.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, invoices)
 }
 
 func getInvoiceByID(w http.ResponseWriter, r *http.Request) {
 	invoiceID := r.URL.Query().Get("id")
-	log.Printf("[BILLING SERVICE] GET /invoice?id=%s\n", invoiceID)
 
-	for _, invoice := range invoices {
-		if invoice.ID == invoiceID {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(invoice)
-			return
-		}
+	invoice, err := invoiceRepo.Get(r.Context(), invoiceID)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
 	}
-
-	http.Error(w, "Invoice not found", http.StatusNotFound)
+	if c := authz.From(r); !c.CanRead(invoice.UserID) {
+		authz.Forbid(w, r, c, "invoice belongs to another user")
+		return
+	}
+	conditional.SetValidators(w, invoice.etag(), invoice.UpdatedAt)
+	if conditional.NotModified(w, r, invoice.etag(), invoice.UpdatedAt) {
+		return
+	}
+	httpjson.Write(w, http.StatusOK, invoice)
 }
 
 func getInvoicesByUser(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
-	log.Printf("[BILLING SERVICE] GET /invoices/user?user_id=%s\n", userID)
+	if c := authz.From(r); !c.CanRead(userID) {
+		authz.Forbid(w, r, c, "invoices of another user")
+		return
+	}
+
+	userInvoices, err := invoiceRepo.ListByUser(r.Context(), userID)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	httpjson.Write(w, http.StatusOK, userInvoices)
+}
+
+// createInvoice issues the invoice for an order. The order ID is the
+// idempotency key: a repeated request for the same order returns the
+// invoice already issued with 200 instead of creating a second one.
+func createInvoice(w http.ResponseWriter, r *http.Request) {
+	if c := authz.From(r); !c.CanWriteAll() {
+		authz.Forbid(w, r, c, "invoices are issued by the orders service")
+		return
+	}
+	var req invoiceRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	fields := map[string]string{}
+	if strings.TrimSpace(req.OrderID) == "" {
+		fields["order_id"] = "order_id is required"
+	}
+	if strings.TrimSpace(req.UserID) == "" {
+		fields["user_id"] = "user_id is required"
+	}
+	if req.Amount <= 0 {
+		fields["amount"] = "amount must be greater than zero"
+	}
+	if len(fields) > 0 {
+		httpjson.Write(w, http.StatusUnprocessableEntity, map[string]any{
+			"error":  "validation failed",
+			"fields": fields,
+		})
+		return
+	}
 
-	var userInvoices []Invoice
-	for _, invoice := range invoices {
-		if invoice.UserID == userID {
-			userInvoices = append(userInvoices, invoice)
+	invoice, created, err := invoiceRepo.CreateForOrder(r.Context(), Invoice{
+		UserID:  req.UserID,
+		OrderID: req.OrderID,
+		Amount:  req.Amount,
+		Status:  "pending",
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/invoice?id="+invoice.ID)
+	conditional.SetValidators(w, invoice.etag(), invoice.UpdatedAt)
+	if !created {
+		if invoice.UserID != req.UserID || invoice.Amount != req.Amount {
+			httpjson.Error(w, http.StatusConflict, "order "+req.OrderID+" already has invoice "+invoice.ID+" with different details")
+			return
 		}
+		httpjson.Write(w, http.StatusOK, invoice)
+		return
 	}
+	slog.InfoContext(r.Context(), "invoice issued", "invoice_id", invoice.ID, "order_id", invoice.OrderID)
+	httpjson.Write(w, http.StatusCreated, invoice)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(userInvoices)
+// registerInvoiceMetrics exposes on /metrics the number of invoices in each
+// status and the amount still unpaid, computed from the repository at every
+// scrape.
+func registerInvoiceMetrics() {
+	list := func() ([]Invoice, bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		invoices, err := invoiceRepo.List(ctx)
+		if err != nil {
+			slog.Error("collecting invoice metrics", "error", err)
+			return nil, false
+		}
+		return invoices, true
+	}
+	telemetry.NewCollected("invoices", "Invoices in each status.", "gauge", []string{"status"}, func(emit func(float64, ...string)) {
+		invoices, ok := list()
+		if !ok {
+			return
+		}
+		counts := map[string]int{}
+		for _, inv := range invoices {
+			counts[inv.Status]++
+		}
+		for _, status := range slices.Sorted(maps.Keys(counts)) {
+			emit(float64(counts[status]), status)
+		}
+	})
+	telemetry.NewCollected("invoices_unpaid_amount", "Total amount of the invoices not yet paid.", "gauge", nil, func(emit func(float64, ...string)) {
+		invoices, ok := list()
+		if !ok {
+			return
+		}
+		var total float64
+		for _, inv := range invoices {
+			if inv.Status != "paid" {
+				total += inv.Amount
+			}
+		}
+		emit(total)
+	})
 }
 
 func main() {
-	http.HandleFunc("/invoices", getInvoices)
-	http.HandleFunc("/invoice", getInvoiceByID)
-	http.HandleFunc("/invoices/user", getInvoicesByUser)
+	srvFlags := server.DefineFlags(":8083")
+	driver := server.EnvString("storage", "STORAGE_DRIVER", "memory", "storage driver: memory or file")
+	storagePath := server.EnvString("storage-path", "STORAGE_PATH", "data/invoices.jsonl", "journal of the file storage")
+	auditPath := server.EnvString("audit-log", "AUDIT_LOG", "data/audit.jsonl", "file the denied requests are recorded in")
+	registry := server.EnvString("registry", "REGISTRY_URL", "", "service registry to register with")
+	logLevel := server.EnvString("log-level", "LOG_LEVEL", "info", "debug, info, warn or error")
+	flagErr := server.ParseFlags()
+	if err := telemetry.InitLogging(serviceName, *logLevel); err != nil {
+		log.Fatalf("[BILLING SERVICE] Logging: %v\n", err)
+	}
+	if flagErr != nil {
+		telemetry.Fatal("invalid settings", "error", flagErr)
+	}
+	flushTraces, err := telemetry.InitTracing(serviceName)
+	if err != nil {
+		telemetry.Fatal("setting up tracing", "error", err)
+	}
+	defer flushTraces()
 
-	port := ":8083"
-	log.Printf("[BILLING SERVICE] Started on port %s\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	storageDriver = *driver
+	repo, err := openInvoiceRepository(*driver, *storagePath)
+	if err != nil {
+		telemetry.Fatal("opening storage", "error", err)
+	}
+	defer repo.Close()
+	invoiceRepo = tracedInvoiceRepository{repo}
+
+	if err := authz.OpenAuditLog(serviceName, *auditPath); err != nil {
+		telemetry.Fatal("opening audit log", "error", err)
+	}
+	if err := authz.LoadServiceToken(); err != nil {
+		telemetry.Fatal("reading the service token", "error", err)
+	}
+
+	http.HandleFunc("GET /invoices", getInvoices)
+	http.HandleFunc("POST /invoices", createInvoice)
+	http.HandleFunc("GET /invoice", getInvoiceByID)
+	http.HandleFunc("GET /invoices/user", getInvoicesByUser)
+	status := health.Service{
+		Name:    serviceName,
+		Version: serviceVersion,
+		Driver:  storageDriver,
+		Checks: map[string]func(context.Context) error{
+			"storage": invoiceRepo.Ping,
+		},
+	}
+	http.HandleFunc("GET /health", status.Liveness)
+	http.HandleFunc("GET /ready", status.Readiness)
+	http.HandleFunc("GET /metrics", telemetry.ServeMetrics)
+	registerInvoiceMetrics()
+
+	deregister, err := discovery.Register(*registry, serviceName, serviceVersion, *srvFlags.Addr, nil)
+	if err != nil {
+		telemetry.Fatal("registering with the service registry", "error", err)
+	}
+	slog.Info("started", "addr", *srvFlags.Addr)
+	srv := srvFlags.Server(telemetry.Handler(http.DefaultServeMux))
+	if err := server.Serve(srv, *srvFlags.ShutdownTimeout, deregister); err != nil {
+		telemetry.Fatal("server stopped", "error", err)
+	}
+	slog.Info("stopped")
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/journal"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// InvoiceRepository is the storage used by the HTTP handlers.
+type InvoiceRepository interface {
+	List(ctx context.Context) ([]Invoice, error)
+	ListByUser(ctx context.Context, userID string) ([]Invoice, error)
+	Get(ctx context.Context, id string) (Invoice, error)
+	// CreateForOrder stores inv under a new ID unless the order already has
+	// an invoice, in which case that invoice is returned with created false.
+	CreateForOrder(ctx context.Context, inv Invoice) (stored Invoice, created bool, err error)
+	// Ping reports whether the storage is usable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var seedInvoices = []Invoice{
+	{ID: "INV-001", UserID: "1", OrderID: "1001", Amount: 3500.00, Status: "paid", PaymentDate: time.Now().AddDate(0, 0, -10)},
+	{ID: "INV-002", UserID: "2", OrderID: "1002", Amount: 100.00, Status: "pending", PaymentDate: time.Time{}},
+	{ID: "INV-003", UserID: "1", OrderID: "1003", Amount: 250.00, Status: "paid", PaymentDate: time.Now().AddDate(0, 0, -2)},
+}
+
+// storageDriver names the storage in use, for /ready and storage spans.
+var storageDriver string
+
+// openInvoiceRepository builds the repository selected by driver ("memory" or
+// "file"). The file driver keeps its journal at path.
+func openInvoiceRepository(driver, path string) (InvoiceRepository, error) {
+	switch driver {
+	case "memory":
+		return newMemoryInvoiceRepository(seedInvoices), nil
+	case "file":
+		return openFileInvoiceRepository(path, seedInvoices)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q (want memory or file)", driver)
+	}
+}
+
+// memoryInvoiceRepository keeps invoices in a slice guarded by a mutex.
+type memoryInvoiceRepository struct {
+	mu         sync.RWMutex
+	invoices   []Invoice
+	lastNumber int
+	// persist, when set, is called with every change before it is applied;
+	// if it fails the change is dropped.
+	persist func(journal.Entry[Invoice]) error
+}
+
+func newMemoryInvoiceRepository(seed []Invoice) *memoryInvoiceRepository {
+	m := &memoryInvoiceRepository{}
+	for _, inv := range seed {
+		m.put(inv)
+	}
+	return m
+}
+
+// put inserts or replaces inv. Callers must hold mu for writing.
+func (m *memoryInvoiceRepository) put(inv Invoice) {
+	if n, err := strconv.Atoi(strings.TrimPrefix(inv.ID, "INV-")); err == nil && n > m.lastNumber {
+		m.lastNumber = n
+	}
+	// Invoices stored before versions existed start at version 1.
+	if inv.Version == 0 {
+		inv.Version, inv.UpdatedAt = 1, time.Now().UTC()
+	}
+	if i := slices.IndexFunc(m.invoices, func(existing Invoice) bool { return existing.ID == inv.ID }); i >= 0 {
+		m.invoices[i] = inv
+		return
+	}
+	m.invoices = append(m.invoices, inv)
+}
+
+func (m *memoryInvoiceRepository) List(ctx context.Context) ([]Invoice, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.invoices), nil
+}
+
+func (m *memoryInvoiceRepository) ListByUser(ctx context.Context, userID string) ([]Invoice, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var invoices []Invoice
+	for _, inv := range m.invoices {
+		if inv.UserID == userID {
+			invoices = append(invoices, inv)
+		}
+	}
+	return invoices, nil
+}
+
+func (m *memoryInvoiceRepository) Get(ctx context.Context, id string) (Invoice, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, inv := range m.invoices {
+		if inv.ID == id {
+			return inv, nil
+		}
+	}
+	return Invoice{}, ErrNotFound
+}
+
+func (m *memoryInvoiceRepository) CreateForOrder(ctx context.Context, inv Invoice) (Invoice, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.invoices {
+		if existing.OrderID == inv.OrderID {
+			return existing, false, nil
+		}
+	}
+
+	// Invoice numbers are never reused.
+	inv.ID = fmt.Sprintf("INV-%03d", m.lastNumber+1)
+	inv.Version, inv.UpdatedAt = 1, time.Now().UTC()
+	if m.persist != nil {
+		if err := m.persist(journal.Entry[Invoice]{Op: "put", ID: inv.ID, Record: &inv}); err != nil {
+			return Invoice{}, false, fmt.Errorf("persisting invoice %s: %w", inv.ID, err)
+		}
+	}
+	m.put(inv)
+	return inv, true, nil
+}
+
+func (m *memoryInvoiceRepository) Ping(ctx context.Context) error { return nil }
+
+func (m *memoryInvoiceRepository) Close() error { return nil }
+
+// fileInvoiceRepository is a memoryInvoiceRepository whose changes are
+// recorded in a journal file, so the data survives restarts.
+type fileInvoiceRepository struct {
+	*memoryInvoiceRepository
+	journal *journal.Journal[Invoice]
+}
+
+// openFileInvoiceRepository loads the invoices stored at path. A new file is
+// started with the seed invoices.
+func openFileInvoiceRepository(path string, seed []Invoice) (*fileInvoiceRepository, error) {
+	m := &memoryInvoiceRepository{}
+	j, existed, err := journal.Open(path, func(entry journal.Entry[Invoice]) {
+		if entry.Record != nil {
+			m.put(*entry.Record)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		for _, inv := range seed {
+			m.put(inv)
+		}
+	}
+
+	snapshot := make([]journal.Entry[Invoice], len(m.invoices))
+	for i := range m.invoices {
+		snapshot[i] = journal.Entry[Invoice]{Op: "put", ID: m.invoices[i].ID, Record: &m.invoices[i]}
+	}
+	if err := j.Compact(snapshot); err != nil {
+		j.Close()
+		return nil, err
+	}
+
+	m.persist = j.Append
+	return &fileInvoiceRepository{memoryInvoiceRepository: m, journal: j}, nil
+}
+
+func (f *fileInvoiceRepository) Ping(ctx context.Context) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.journal.Check()
+}
+
+func (f *fileInvoiceRepository) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.journal.Close()
+}
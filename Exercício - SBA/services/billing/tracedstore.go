@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+
+	"platform/telemetry"
+)
+
+// tracedInvoiceRepository records a span for every call to an
+// InvoiceRepository.
+type tracedInvoiceRepository struct{ InvoiceRepository }
+
+func (t tracedInvoiceRepository) List(ctx context.Context) ([]Invoice, error) {
+	return telemetry.TraceStorage(ctx, "InvoiceRepository.List", storageDriver, ErrNotFound, t.InvoiceRepository.List)
+}
+
+func (t tracedInvoiceRepository) ListByUser(ctx context.Context, userID string) ([]Invoice, error) {
+	return telemetry.TraceStorage(ctx, "InvoiceRepository.ListByUser", storageDriver, ErrNotFound, func(ctx context.Context) ([]Invoice, error) {
+		return t.InvoiceRepository.ListByUser(ctx, userID)
+	})
+}
+
+func (t tracedInvoiceRepository) Get(ctx context.Context, id string) (Invoice, error) {
+	return telemetry.TraceStorage(ctx, "InvoiceRepository.Get", storageDriver, ErrNotFound, func(ctx context.Context) (Invoice, error) {
+		return t.InvoiceRepository.Get(ctx, id)
+	})
+}
+
+func (t tracedInvoiceRepository) CreateForOrder(ctx context.Context, inv Invoice) (Invoice, bool, error) {
+	type result struct {
+		inv     Invoice
+		created bool
+	}
+	r, err := telemetry.TraceStorage(ctx, "InvoiceRepository.CreateForOrder", storageDriver, ErrNotFound, func(ctx context.Context) (result, error) {
+		inv, created, err := t.InvoiceRepository.CreateForOrder(ctx, inv)
+		return result{inv, created}, err
+	})
+	return r.inv, r.created, err
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"platform/authz"
+	"platform/discovery"
+	"platform/telemetry"
+)
+
+// billingLookupTTL is how long the billing instances listed by the
+// registry are used before asking it again.
+const billingLookupTTL = 10 * time.Second
+
+// billingAttempts bounds how many times a new order is announced to billing
+// before leaving it to the next reconciliation; the delay doubles after
+// every failed attempt.
+const (
+	billingAttempts     = 5
+	billingInitialDelay = time.Second
+)
+
+// billingReconcileInterval is how often the orders are compared with the
+// invoices billing holds, to request those that were never issued.
+const billingReconcileInterval = time.Minute
+
+var billingClient = &http.Client{Timeout: 5 * time.Second}
+
+// billingPending counts the orders still being announced to billing.
+var billingPending sync.WaitGroup
+
+// billingLocator finds the billing instance to send invoice requests to.
+type billingLocator struct {
+	registry string // base URL of the service registry, "" without one
+	fallback string // used when the registry lists no billing instance
+
+	mu      sync.Mutex
+	urls    []string // the instances the registry listed last
+	fetched time.Time
+}
+
+// billing locates the billing service; main sets it up from the flags.
+var billing *billingLocator
+
+func newBillingLocator(registry, fallback string) *billingLocator {
+	return &billingLocator{registry: strings.TrimSuffix(registry, "/"), fallback: strings.TrimSuffix(fallback, "/")}
+}
+
+// url returns the address of a billing instance: one of those listed in
+// the registry, picked at random, or the fallback address when there is no
+// registry or it lists none. When the registry cannot be reached, the
+// instances it listed last are used.
+func (b *billingLocator) url() string {
+	if b.registry == "" {
+		return b.fallback
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.fetched) >= billingLookupTTL {
+		urls, err := lookupInstances(b.registry, "billing")
+		if err != nil {
+			slog.Warn("looking up billing in the service registry", "registry", b.registry, "error", err)
+		} else {
+			b.urls = urls
+		}
+		b.fetched = time.Now()
+	}
+	if len(b.urls) > 0 {
+		return b.urls[rand.IntN(len(b.urls))]
+	}
+	return b.fallback
+}
+
+// lookupInstances returns the addresses of the live instances of service
+// listed by the registry at base.
+func lookupInstances(base, service string) ([]string, error) {
+	resp, err := discovery.Client.Get(base + "/services/" + url.PathEscape(service))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry answered %s", resp.Status)
+	}
+	var instances []struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&instances); err != nil {
+		return nil, err
+	}
+	urls := make([]string, 0, len(instances))
+	for _, in := range instances {
+		urls = append(urls, strings.TrimSuffix(in.Address, "/"))
+	}
+	return urls, nil
+}
+
+// invoiceRequest is the body billing expects on POST /invoices.
+type invoiceRequest struct {
+	OrderID string  `json:"order_id"`
+	UserID  string  `json:"user_id"`
+	Amount  float64 `json:"amount"`
+}
+
+// requestInvoice asks billing to issue the invoice for order. Billing treats
+// the order ID as an idempotency key, so repeating the call is always safe.
+func requestInvoice(ctx context.Context, order Order) (err error) {
+	ctx, span := telemetry.StartSpan(ctx, "POST billing", telemetry.SpanKindClient)
+	defer func() {
+		span.Fail(err)
+		span.Finish()
+	}()
+	body, err := json.Marshal(invoiceRequest{OrderID: order.ID, UserID: order.UserID, Amount: order.Total})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, billing.url()+"/invoices", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	telemetry.InjectTrace(ctx, req.Header)
+	telemetry.PropagateRequestID(ctx, req.Header)
+	authz.Vouch(req.Header, serviceName)
+	resp, err := billingClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("billing answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// notifyBilling announces a newly placed order to billing in the background,
+// retrying with exponential backoff so the invoice survives a short billing
+// outage without waiting for reconcileInvoices. The calls belong to the
+// trace of ctx but outlive its request.
+func notifyBilling(ctx context.Context, order Order) {
+	ctx = context.WithoutCancel(ctx)
+	billingPending.Add(1)
+	go func() {
+		defer billingPending.Done()
+		delay := billingInitialDelay
+		for attempt := 1; attempt <= billingAttempts; attempt++ {
+			err := requestInvoice(ctx, order)
+			if err == nil {
+				slog.InfoContext(ctx, "invoice requested", "order_id", order.ID)
+				return
+			}
+			slog.WarnContext(ctx, "invoice request failed",
+				"order_id", order.ID, "attempt", attempt, "attempts", billingAttempts, "error", err)
+			if attempt < billingAttempts {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+		slog.WarnContext(ctx, "invoice not requested, leaving it to the reconciliation", "order_id", order.ID)
+	}()
+}
+
+// invoicedOrders returns the IDs of the orders billing holds an invoice for.
+func invoicedOrders(ctx context.Context) (map[string]bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, billing.url()+"/invoices", nil)
+	if err != nil {
+		return nil, err
+	}
+	telemetry.InjectTrace(ctx, req.Header)
+	authz.Vouch(req.Header, serviceName)
+	resp, err := billingClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("billing answered %d", resp.StatusCode)
+	}
+	var invoices []struct {
+		OrderID string `json:"order_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&invoices); err != nil {
+		return nil, fmt.Errorf("decoding billing answer: %w", err)
+	}
+	invoiced := make(map[string]bool, len(invoices))
+	for _, inv := range invoices {
+		invoiced[inv.OrderID] = true
+	}
+	return invoiced, nil
+}
+
+// reconcileInvoices requests the invoice of every order billing holds none
+// for: orders whose announcement kept failing, or was cut short when the
+// service stopped. An order placed meanwhile may be announced twice, which
+// billing ignores. An order billing turns down does not hold back the
+// others: every failure is logged and they are returned together.
+func reconcileInvoices(ctx context.Context) error {
+	invoiced, err := invoicedOrders(ctx)
+	if err != nil {
+		return fmt.Errorf("listing invoices: %w", err)
+	}
+	orders, err := orderRepo.List(ctx)
+	if err != nil {
+		return fmt.Errorf("listing orders: %w", err)
+	}
+	var errs []error
+	for _, order := range orders {
+		if invoiced[order.ID] {
+			continue
+		}
+		if err := requestInvoice(ctx, order); err != nil {
+			slog.WarnContext(ctx, "requesting a missing invoice", "order_id", order.ID, "error", err)
+			errs = append(errs, fmt.Errorf("requesting the invoice of order %s: %w", order.ID, err))
+			continue
+		}
+		slog.InfoContext(ctx, "missing invoice requested", "order_id", order.ID)
+	}
+	return errors.Join(errs...)
+}
+
+// watchInvoices reconciles the orders with billing at startup and then
+// every billingReconcileInterval. It never returns.
+func watchInvoices() {
+	for {
+		ctx, span := telemetry.StartSpan(context.Background(), "reconcile invoices", telemetry.SpanKindInternal)
+		if err := reconcileInvoices(ctx); err != nil {
+			span.Fail(err)
+			slog.WarnContext(ctx, "reconciling invoices with billing", "error", err)
+		}
+		span.Finish()
+		time.Sleep(billingReconcileInterval)
+	}
+}
+
+// waitForBilling waits for the orders being announced to billing, for at
+// most timeout, so that a shutdown does not drop their invoices. It reports
+// whether they were all announced.
+func waitForBilling(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		billingPending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -1,3 +1,7 @@
 module orders
 
 go 1.25.4
+
+require platform v0.0.0
+
+replace platform => ../../platform
@@ -1,69 +1,446 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"platform/authz"
+	"platform/conditional"
+	"platform/discovery"
+	"platform/health"
+	"platform/httpjson"
+	"platform/server"
+	"platform/telemetry"
+)
+
+// serviceName and serviceVersion are reported by /health and /ready and
+// announced to the registry.
+const (
+	serviceName    = "orders"
+	serviceVersion = "1.0.0"
+)
+
+type OrderStatus string
+
+const (
+	StatusPending    OrderStatus = "pending"
+	StatusPaid       OrderStatus = "paid"
+	StatusProcessing OrderStatus = "processing"
+	StatusShipped    OrderStatus = "shipped"
+	StatusDelivered  OrderStatus = "delivered"
+	StatusCancelled  OrderStatus = "cancelled"
+	StatusRefunded   OrderStatus = "refunded"
 )
 
+// transitions lists, for each status, the statuses an order may move to next.
+// Cancelled and refunded are final.
+var transitions = map[OrderStatus][]OrderStatus{
+	StatusPending:    {StatusPaid, StatusCancelled},
+	StatusPaid:       {StatusProcessing, StatusRefunded},
+	StatusProcessing: {StatusShipped, StatusRefunded},
+	StatusShipped:    {StatusDelivered},
+	StatusDelivered:  {StatusRefunded},
+}
+
+// actions maps the transition endpoints (/order/{action}) to target statuses.
+var actions = map[string]OrderStatus{
+	"pay":     StatusPaid,
+	"process": StatusProcessing,
+	"ship":    StatusShipped,
+	"deliver": StatusDelivered,
+	"cancel":  StatusCancelled,
+	"refund":  StatusRefunded,
+}
+
+// catalog holds the unit price of every product that can be ordered. Order
+// totals are computed from it, never taken from the client.
+var catalog = map[string]float64{
+	"Notebook": 3500.00,
+	"Monitor":  1200.00,
+	"Keyboard": 250.00,
+	"Mouse":    50.00,
+}
+
+// orderTotal is the price of quantity units of product, in whole cents.
+func orderTotal(product string, quantity int) float64 {
+	return math.Round(catalog[product]*float64(quantity)*100) / 100
+}
+
+// StatusChange records one step of an order's life cycle.
+type StatusChange struct {
+	From OrderStatus `json:"from,omitempty"`
+	To   OrderStatus `json:"to"`
+	At   time.Time   `json:"at"`
+}
+
 type Order struct {
-	ID       string  `json:"id"`
+	ID        string         `json:"id"`
+	UserID    string         `json:"user_id"`
+	Product   string         `json:"product"`
+	Quantity  int            `json:"quantity"`
+	Total     float64        `json:"total"`
+	Status    OrderStatus    `json:"status"`
+	CreatedAt time.Time      `json:"created_at"`
+	History   []StatusChange `json:"history"`
+	// Version counts the changes made to the order and, with UpdatedAt,
+	// forms its ETag; both are maintained by the repository.
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// etag is the entity tag of the order's current version.
+func (o Order) etag() string { return conditional.EntityTag(o.Version, o.UpdatedAt) }
+
+// orderInput is the body accepted by POST /orders. Total is optional: the
+// order's total is computed from the catalog, and a total sent along must
+// match it, so a client showing a stale price finds out.
+type orderInput struct {
 	UserID   string  `json:"user_id"`
 	Product  string  `json:"product"`
 	Quantity int     `json:"quantity"`
-	Total    float64 `json:"total"`
-	Status   string  `json:"status"`
+	Total    float64 `json:"total,omitempty"`
+}
+
+// canTransition reports whether an order in status from may move to to.
+func canTransition(from, to OrderStatus) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
 }
 
-var orders = []Order{
-	{ID: "1001", UserID: "1", Product: "Notebook", Quantity: 1, Total: 3500.00, Status: "delivered"},
-	{ID: "1002", UserID: "2", Product: "Mouse", Quantity: 2, Total: 100.00, Status: "processing"},
-	{ID: "1003", UserID: "1", Product: "Keyboard", Quantity: 1, Total: 250.00, Status: "shipped"},
+// transition moves o to status to, appending the change to its history.
+func (o *Order) transition(to OrderStatus, at time.Time) bool {
+	if !canTransition(o.Status, to) {
+		return false
+	}
+	o.History = append(o.History, StatusChange{From: o.Status, To: to, At: at})
+	o.Status = to
+	return true
+}
+
+// seedOrder builds an example order that walked through the given statuses,
+// one day apart, ending today.
+func seedOrder(id, userID, product string, quantity int, total float64, path ...OrderStatus) Order {
+	created := time.Now().AddDate(0, 0, -len(path))
+	o := Order{ID: id, UserID: userID, Product: product, Quantity: quantity, Total: total,
+		Status: StatusPending, CreatedAt: created,
+		History: []StatusChange{{To: StatusPending, At: created}}}
+	for i, status := range path {
+		o.transition(status, created.AddDate(0, 0, i+1))
+	}
+	return o
+}
+
+// orderRepo holds every order; it is chosen at startup by openOrderRepository.
+var orderRepo OrderRepository
+
+// transitionError is returned when the transition table forbids a change.
+type transitionError struct {
+	from, to OrderStatus
+}
+
+func (e *transitionError) Error() string {
+	return "cannot move order from " + string(e.from) + " to " + string(e.to)
+}
+
+// writeStoreError maps repository errors to responses.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	var illegal *transitionError
+	switch {
+	case errors.As(err, &illegal):
+		allowed := transitions[illegal.from]
+		if allowed == nil {
+			allowed = []OrderStatus{}
+		}
+		httpjson.Write(w, http.StatusConflict, map[string]any{
+			"error":   illegal.Error(),
+			"status":  illegal.from,
+			"allowed": allowed,
+		})
+	case errors.Is(err, ErrNotFound):
+		httpjson.Error(w, http.StatusNotFound, "Order not found")
+	default:
+		slog.ErrorContext(r.Context(), "storage error", "error", err)
+		httpjson.Error(w, http.StatusInternalServerError, "storage error")
+	}
+}
+
+// validateOrder returns the fields of in that are missing or out of range.
+func validateOrder(in orderInput) map[string]string {
+	fields := map[string]string{}
+	if strings.TrimSpace(in.UserID) == "" {
+		fields["user_id"] = "user_id is required"
+	}
+	product := strings.TrimSpace(in.Product)
+	_, known := catalog[product]
+	switch {
+	case product == "":
+		fields["product"] = "product is required"
+	case !known:
+		fields["product"] = "unknown product, expected one of " + strings.Join(slices.Sorted(maps.Keys(catalog)), ", ")
+	}
+	if in.Quantity < 1 {
+		fields["quantity"] = "quantity must be at least 1"
+	}
+	if in.Total != 0 && known && in.Quantity >= 1 {
+		if total := orderTotal(product, in.Quantity); math.Round(in.Total*100)/100 != total {
+			fields["total"] = fmt.Sprintf("total does not match the price of the order (%.2f)", total)
+		}
+	}
+	return fields
 }
 
 func getOrders(w http.ResponseWriter, r *http.Request) {
-	log.Println("[ORDERS SERVICE] GET /orders")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	if c := authz.From(r); !c.CanReadAll() {
+		authz.Forbid(w, r, c, "only support and admin may list every order")
+		return
+	}
+	orders, err := orderRepo.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, orders)
 }
 
 func getOrderByID(w http.ResponseWriter, r *http.Request) {
 	orderID := r.URL.Query().Get("id")
-	log.Printf("[ORDERS SERVICE] GET /order?id=%s\n", orderID)
 
-	for _, order := range orders {
-		if order.ID == orderID {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(order)
-			return
-		}
+	order, err := orderRepo.Get(r.Context(), orderID)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
 	}
-
-	http.Error(w, "Order not found", http.StatusNotFound)
+	if c := authz.From(r); !c.CanRead(order.UserID) {
+		authz.Forbid(w, r, c, "order belongs to another user")
+		return
+	}
+	conditional.SetValidators(w, order.etag(), order.UpdatedAt)
+	if conditional.NotModified(w, r, order.etag(), order.UpdatedAt) {
+		return
+	}
+	httpjson.Write(w, http.StatusOK, order)
 }
 
 func getOrdersByUser(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
-	log.Printf("[ORDERS SERVICE] GET /orders/user?user_id=%s\n", userID)
+	if c := authz.From(r); !c.CanRead(userID) {
+		authz.Forbid(w, r, c, "orders of another user")
+		return
+	}
+
+	userOrders, err := orderRepo.ListByUser(r.Context(), userID)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, userOrders)
+}
+
+// placeOrder creates a new order in the pending status.
+func placeOrder(w http.ResponseWriter, r *http.Request) {
+	var in orderInput
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return
+	}
+	if fields := validateOrder(in); len(fields) > 0 {
+		httpjson.Write(w, http.StatusUnprocessableEntity, map[string]any{
+			"error":  "validation failed",
+			"fields": fields,
+		})
+		return
+	}
+	if c := authz.From(r); !c.CanWrite(strings.TrimSpace(in.UserID)) {
+		authz.Forbid(w, r, c, "cannot place orders for another user")
+		return
+	}
+
+	now := time.Now()
+	order, err := orderRepo.Create(r.Context(), Order{
+		UserID:    strings.TrimSpace(in.UserID),
+		Product:   strings.TrimSpace(in.Product),
+		Quantity:  in.Quantity,
+		Total:     orderTotal(strings.TrimSpace(in.Product), in.Quantity),
+		Status:    StatusPending,
+		CreatedAt: now,
+		History:   []StatusChange{{To: StatusPending, At: now}},
+	})
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "order placed", "order_id", order.ID, "user_id", order.UserID)
+	notifyBilling(r.Context(), order)
+	w.Header().Set("Location", "/order?id="+order.ID)
+	conditional.SetValidators(w, order.etag(), order.UpdatedAt)
+	httpjson.Write(w, http.StatusCreated, order)
+}
+
+// customerActions are the actions customers may take on their own orders;
+// every other action, paying included, is reserved to admin and to the
+// other services.
+var customerActions = map[string]bool{"cancel": true}
+
+// transitionOrder handles POST /order/{action}?id=, moving the order to the
+// status associated with action if the transition table allows it. If-Match
+// must carry the ETag of the order as last read, so two conflicting actions
+// cannot both apply.
+func transitionOrder(w http.ResponseWriter, r *http.Request) {
+	action := r.PathValue("action")
+	orderID := r.URL.Query().Get("id")
+
+	to, ok := actions[action]
+	if !ok {
+		httpjson.Error(w, http.StatusNotFound, "Unknown order action: "+action)
+		return
+	}
+
+	current, err := orderRepo.Get(r.Context(), orderID)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if c := authz.From(r); !c.CanWriteAll() && !(customerActions[action] && c.CanWrite(current.UserID)) {
+		authz.Forbid(w, r, c, "not allowed to "+action+" this order")
+		return
+	}
+	ifMatch, ok := conditional.RequireIfMatch(w, r)
+	if !ok {
+		return
+	}
 
-	var userOrders []Order
-	for _, order := range orders {
-		if order.UserID == userID {
-			userOrders = append(userOrders, order)
+	var from OrderStatus
+	var etag string
+	order, err := orderRepo.Update(r.Context(), orderID, func(o *Order) error {
+		etag = o.etag()
+		if err := conditional.CheckIfMatch(ifMatch, etag); err != nil {
+			return err
+		}
+		from = o.Status
+		if !o.transition(to, time.Now()) {
+			return &transitionError{from: from, to: to}
 		}
+		return nil
+	})
+	if errors.Is(err, conditional.ErrPreconditionFailed) {
+		conditional.WritePreconditionFailed(w, etag)
+		return
 	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "order status changed", "order_id", order.ID, "from", from, "to", to)
+	conditional.SetValidators(w, order.etag(), order.UpdatedAt)
+	httpjson.Write(w, http.StatusOK, order)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(userOrders)
+// registerOrderMetrics exposes the number of orders in each status on
+// /metrics, counted from the repository at every scrape.
+func registerOrderMetrics() {
+	telemetry.NewCollected("orders", "Orders in each status.", "gauge", []string{"status"}, func(emit func(float64, ...string)) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		orders, err := orderRepo.List(ctx)
+		if err != nil {
+			slog.Error("collecting order metrics", "error", err)
+			return
+		}
+		counts := map[OrderStatus]int{}
+		for _, o := range orders {
+			counts[o.Status]++
+		}
+		for _, status := range []OrderStatus{StatusPending, StatusPaid, StatusProcessing, StatusShipped, StatusDelivered, StatusCancelled, StatusRefunded} {
+			emit(float64(counts[status]), string(status))
+		}
+	})
 }
 
 func main() {
-	http.HandleFunc("/orders", getOrders)
-	http.HandleFunc("/order", getOrderByID)
-	http.HandleFunc("/orders/user", getOrdersByUser)
+	srvFlags := server.DefineFlags(":8082")
+	driver := server.EnvString("storage", "STORAGE_DRIVER", "memory", "storage driver: memory or file")
+	storagePath := server.EnvString("storage-path", "STORAGE_PATH", "data/orders.jsonl", "journal of the file storage")
+	billingURL := server.EnvString("billing-url", "BILLING_URL", "http://localhost:8083", "billing service, when the registry lists none")
+	auditPath := server.EnvString("audit-log", "AUDIT_LOG", "data/audit.jsonl", "file the denied requests are recorded in")
+	registry := server.EnvString("registry", "REGISTRY_URL", "", "service registry to register with and find billing in")
+	logLevel := server.EnvString("log-level", "LOG_LEVEL", "info", "debug, info, warn or error")
+	flagErr := server.ParseFlags()
+	if err := telemetry.InitLogging(serviceName, *logLevel); err != nil {
+		log.Fatalf("[ORDERS SERVICE] Logging: %v\n", err)
+	}
+	if flagErr != nil {
+		telemetry.Fatal("invalid settings", "error", flagErr)
+	}
+	flushTraces, err := telemetry.InitTracing(serviceName)
+	if err != nil {
+		telemetry.Fatal("setting up tracing", "error", err)
+	}
+	defer flushTraces()
+
+	storageDriver = *driver
+	repo, err := openOrderRepository(*driver, *storagePath)
+	if err != nil {
+		telemetry.Fatal("opening storage", "error", err)
+	}
+	defer repo.Close()
+	orderRepo = tracedOrderRepository{repo}
+	billing = newBillingLocator(*registry, *billingURL)
+
+	if err := authz.OpenAuditLog(serviceName, *auditPath); err != nil {
+		telemetry.Fatal("opening audit log", "error", err)
+	}
+	if err := authz.LoadServiceToken(); err != nil {
+		telemetry.Fatal("reading the service token", "error", err)
+	}
 
-	port := ":8082"
-	log.Printf("[ORDERS SERVICE] Started on port %s\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	http.HandleFunc("GET /orders", getOrders)
+	http.HandleFunc("POST /orders", placeOrder)
+	http.HandleFunc("GET /order", getOrderByID)
+	http.HandleFunc("POST /order/{action}", transitionOrder)
+	http.HandleFunc("GET /orders/user", getOrdersByUser)
+	status := health.Service{
+		Name:    serviceName,
+		Version: serviceVersion,
+		Driver:  storageDriver,
+		Checks: map[string]func(context.Context) error{
+			"storage": orderRepo.Ping,
+		},
+	}
+	http.HandleFunc("GET /health", status.Liveness)
+	http.HandleFunc("GET /ready", status.Readiness)
+	http.HandleFunc("GET /metrics", telemetry.ServeMetrics)
+	registerOrderMetrics()
+	go watchInvoices()
+
+	deregister, err := discovery.Register(*registry, serviceName, serviceVersion, *srvFlags.Addr, nil)
+	if err != nil {
+		telemetry.Fatal("registering with the service registry", "error", err)
+	}
+	slog.Info("started", "addr", *srvFlags.Addr)
+	srv := srvFlags.Server(telemetry.Handler(http.DefaultServeMux))
+	if err := server.Serve(srv, *srvFlags.ShutdownTimeout, deregister); err != nil {
+		telemetry.Fatal("server stopped", "error", err)
+	}
+	if !waitForBilling(*srvFlags.ShutdownTimeout) {
+		slog.Warn("stopping with invoice requests still pending")
+	}
+	slog.Info("stopped")
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/journal"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// OrderRepository is the storage used by the HTTP handlers.
+type OrderRepository interface {
+	List(ctx context.Context) ([]Order, error)
+	ListByUser(ctx context.Context, userID string) ([]Order, error)
+	Get(ctx context.Context, id string) (Order, error)
+	// Create assigns a new ID to o and stores it at version 1.
+	Create(ctx context.Context, o Order) (Order, error)
+	// Update loads the order, lets mutate change it and stores the result
+	// atomically as the next version. An error from mutate aborts the
+	// update and is returned.
+	Update(ctx context.Context, id string, mutate func(*Order) error) (Order, error)
+	// Ping reports whether the storage is usable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var seedOrders = []Order{
+	seedOrder("1001", "1", "Notebook", 1, 3500.00, StatusPaid, StatusProcessing, StatusShipped, StatusDelivered),
+	seedOrder("1002", "2", "Mouse", 2, 100.00, StatusPaid, StatusProcessing),
+	seedOrder("1003", "1", "Keyboard", 1, 250.00, StatusPaid, StatusProcessing, StatusShipped),
+}
+
+// storageDriver names the storage in use, for /ready and storage spans.
+var storageDriver string
+
+// openOrderRepository builds the repository selected by driver ("memory" or
+// "file"). The file driver keeps its journal at path.
+func openOrderRepository(driver, path string) (OrderRepository, error) {
+	switch driver {
+	case "memory":
+		return newMemoryOrderRepository(seedOrders), nil
+	case "file":
+		return openFileOrderRepository(path, seedOrders)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q (want memory or file)", driver)
+	}
+}
+
+// cloneOrder copies o so callers never share its history with the store.
+func cloneOrder(o Order) Order {
+	o.History = slices.Clone(o.History)
+	return o
+}
+
+// memoryOrderRepository keeps orders in a slice guarded by a mutex.
+type memoryOrderRepository struct {
+	mu     sync.RWMutex
+	orders []Order
+	lastID int
+	// persist, when set, is called with every change before it is applied;
+	// if it fails the change is dropped.
+	persist func(journal.Entry[Order]) error
+}
+
+func newMemoryOrderRepository(seed []Order) *memoryOrderRepository {
+	m := &memoryOrderRepository{}
+	for _, o := range seed {
+		m.put(cloneOrder(o))
+	}
+	return m
+}
+
+// put inserts or replaces o. Callers must hold mu for writing.
+func (m *memoryOrderRepository) put(o Order) {
+	// Orders stored before versions existed start at version 1, last
+	// changed by their latest status change.
+	if o.Version == 0 {
+		o.Version, o.UpdatedAt = 1, o.CreatedAt
+		if n := len(o.History); n > 0 {
+			o.UpdatedAt = o.History[n-1].At
+		}
+	}
+	if n, err := strconv.Atoi(o.ID); err == nil && n > m.lastID {
+		m.lastID = n
+	}
+	if i := m.index(o.ID); i >= 0 {
+		m.orders[i] = o
+		return
+	}
+	m.orders = append(m.orders, o)
+}
+
+// index returns the position of the order with the given ID, or -1.
+// Callers must hold mu.
+func (m *memoryOrderRepository) index(id string) int {
+	return slices.IndexFunc(m.orders, func(o Order) bool { return o.ID == id })
+}
+
+// commit persists a change (if a journal is attached) and then applies it.
+// Callers must hold mu for writing.
+func (m *memoryOrderRepository) commit(o Order) error {
+	if m.persist != nil {
+		if err := m.persist(journal.Entry[Order]{Op: "put", ID: o.ID, Record: &o}); err != nil {
+			return fmt.Errorf("persisting order %s: %w", o.ID, err)
+		}
+	}
+	m.put(o)
+	return nil
+}
+
+func (m *memoryOrderRepository) List(ctx context.Context) ([]Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	orders := make([]Order, len(m.orders))
+	for i, o := range m.orders {
+		orders[i] = cloneOrder(o)
+	}
+	return orders, nil
+}
+
+func (m *memoryOrderRepository) ListByUser(ctx context.Context, userID string) ([]Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var orders []Order
+	for _, o := range m.orders {
+		if o.UserID == userID {
+			orders = append(orders, cloneOrder(o))
+		}
+	}
+	return orders, nil
+}
+
+func (m *memoryOrderRepository) Get(ctx context.Context, id string) (Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i := m.index(id); i >= 0 {
+		return cloneOrder(m.orders[i]), nil
+	}
+	return Order{}, ErrNotFound
+}
+
+func (m *memoryOrderRepository) Create(ctx context.Context, o Order) (Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// IDs are never reused, so invoices always point at the right order.
+	o.ID = strconv.Itoa(m.lastID + 1)
+	o.Version, o.UpdatedAt = 1, time.Now().UTC()
+	o = cloneOrder(o)
+	if err := m.commit(o); err != nil {
+		return Order{}, err
+	}
+	return cloneOrder(o), nil
+}
+
+func (m *memoryOrderRepository) Update(ctx context.Context, id string, mutate func(*Order) error) (Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(id)
+	if i < 0 {
+		return Order{}, ErrNotFound
+	}
+	o := cloneOrder(m.orders[i])
+	if err := mutate(&o); err != nil {
+		return Order{}, err
+	}
+	o.ID = id
+	o.Version, o.UpdatedAt = m.orders[i].Version+1, time.Now().UTC()
+	if err := m.commit(o); err != nil {
+		return Order{}, err
+	}
+	return cloneOrder(o), nil
+}
+
+func (m *memoryOrderRepository) Ping(ctx context.Context) error { return nil }
+
+func (m *memoryOrderRepository) Close() error { return nil }
+
+// fileOrderRepository is a memoryOrderRepository whose changes are recorded
+// in a journal file, so the data survives restarts.
+type fileOrderRepository struct {
+	*memoryOrderRepository
+	journal *journal.Journal[Order]
+}
+
+// openFileOrderRepository loads the orders stored at path. A new file is
+// started with the seed orders.
+func openFileOrderRepository(path string, seed []Order) (*fileOrderRepository, error) {
+	m := &memoryOrderRepository{}
+	j, existed, err := journal.Open(path, func(entry journal.Entry[Order]) {
+		if entry.Record != nil {
+			m.put(*entry.Record)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		for _, o := range seed {
+			m.put(cloneOrder(o))
+		}
+	}
+
+	snapshot := make([]journal.Entry[Order], len(m.orders))
+	for i := range m.orders {
+		snapshot[i] = journal.Entry[Order]{Op: "put", ID: m.orders[i].ID, Record: &m.orders[i]}
+	}
+	if err := j.Compact(snapshot); err != nil {
+		j.Close()
+		return nil, err
+	}
+
+	m.persist = j.Append
+	return &fileOrderRepository{memoryOrderRepository: m, journal: j}, nil
+}
+
+func (f *fileOrderRepository) Ping(ctx context.Context) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.journal.Check()
+}
+
+func (f *fileOrderRepository) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.journal.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+
+	"platform/telemetry"
+)
+
+// tracedOrderRepository records a span for every call to an OrderRepository.
+type tracedOrderRepository struct{ OrderRepository }
+
+func (t tracedOrderRepository) List(ctx context.Context) ([]Order, error) {
+	return telemetry.TraceStorage(ctx, "OrderRepository.List", storageDriver, ErrNotFound, t.OrderRepository.List)
+}
+
+func (t tracedOrderRepository) ListByUser(ctx context.Context, userID string) ([]Order, error) {
+	return telemetry.TraceStorage(ctx, "OrderRepository.ListByUser", storageDriver, ErrNotFound, func(ctx context.Context) ([]Order, error) {
+		return t.OrderRepository.ListByUser(ctx, userID)
+	})
+}
+
+func (t tracedOrderRepository) Get(ctx context.Context, id string) (Order, error) {
+	return telemetry.TraceStorage(ctx, "OrderRepository.Get", storageDriver, ErrNotFound, func(ctx context.Context) (Order, error) {
+		return t.OrderRepository.Get(ctx, id)
+	})
+}
+
+func (t tracedOrderRepository) Create(ctx context.Context, o Order) (Order, error) {
+	return telemetry.TraceStorage(ctx, "OrderRepository.Create", storageDriver, ErrNotFound, func(ctx context.Context) (Order, error) {
+		return t.OrderRepository.Create(ctx, o)
+	})
+}
+
+func (t tracedOrderRepository) Update(ctx context.Context, id string, mutate func(*Order) error) (Order, error) {
+	return telemetry.TraceStorage(ctx, "OrderRepository.Update", storageDriver, ErrNotFound, func(ctx context.Context) (Order, error) {
+		return t.OrderRepository.Update(ctx, id, mutate)
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"platform/authz"
+	"platform/httpjson"
+)
+
+// credentialRepo holds passwords and refresh tokens; tokens signs the
+// tokens handed out on login. Both are set up at startup.
+var (
+	credentialRepo CredentialRepository
+	tokens         *tokenIssuer
+)
+
+// tokenResponse is the answer to a successful login or refresh, in the
+// shape of an OAuth 2.0 token response (RFC 6749, section 5.1).
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+	User             User   `json:"user"`
+}
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type passwordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// seedCredentials gives the seed users that still exist and have no password
+// the given password, SEED_PASSWORD, so a development setup can log in.
+// Without one nothing is seeded and the seed users, admin included, cannot
+// log in.
+func seedCredentials(ctx context.Context, password string) error {
+	if password == "" {
+		return nil
+	}
+	if problem := validatePassword(password); problem != "" {
+		return errors.New("seed " + problem)
+	}
+	for _, seed := range seedUsers {
+		if _, err := userRepo.Get(ctx, seed.ID); err != nil {
+			continue
+		}
+		if _, err := credentialRepo.Password(ctx, seed.ID); !errors.Is(err, ErrNotFound) {
+			continue
+		}
+		hash, err := hashPassword(password)
+		if err != nil {
+			return err
+		}
+		if err := credentialRepo.SetPassword(ctx, seed.ID, hash); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "seed user can log in with the seed password", "user_id", seed.ID, "email", seed.Email)
+	}
+	return nil
+}
+
+// issueTokens starts a new session for u: a short-lived access token and a
+// refresh token to obtain the next ones.
+func issueTokens(ctx context.Context, u User) (tokenResponse, error) {
+	now := time.Now()
+	access, err := tokens.accessToken(u, now)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	refresh, err := randomToken(32)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	err = credentialRepo.AddRefreshToken(ctx, RefreshToken{
+		Hash:      hashToken(refresh),
+		UserID:    u.ID,
+		IssuedAt:  now.UTC(),
+		ExpiresAt: now.Add(tokens.refreshTTL).UTC(),
+	})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	return tokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(tokens.accessTTL.Seconds()),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int(tokens.refreshTTL.Seconds()),
+		User:             u,
+	}, nil
+}
+
+// writeTokens sends a new token response for u, which must never be cached.
+func writeTokens(w http.ResponseWriter, r *http.Request, u User) {
+	resp, err := issueTokens(r.Context(), u)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	httpjson.Write(w, http.StatusOK, resp)
+}
+
+// writeInvalidCredentials answers a failed login or refresh without telling
+// which part was wrong.
+func writeInvalidCredentials(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="sba"`)
+	httpjson.Error(w, http.StatusUnauthorized, message)
+}
+
+// login exchanges an email and password for tokens.
+func login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	email := normalizeEmail(req.Email)
+
+	u, err := userRepo.GetByEmail(r.Context(), email)
+	if errors.Is(err, ErrNotFound) {
+		checkPassword(dummyHash(), req.Password)
+		writeInvalidCredentials(w, "invalid email or password")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	hash, err := credentialRepo.Password(r.Context(), u.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		writeStoreError(w, r, err)
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		// A user without a password cannot log in, but answering at once
+		// would tell which accounts have none.
+		checkPassword(dummyHash(), req.Password)
+	}
+	if err != nil || !checkPassword(hash, req.Password) {
+		slog.InfoContext(r.Context(), "failed login", "user_id", u.ID)
+		writeInvalidCredentials(w, "invalid email or password")
+		return
+	}
+	writeTokens(w, r, u)
+}
+
+// refresh exchanges a refresh token for a new access and refresh token. The
+// old refresh token stops working; presenting it again revokes the session.
+func refresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	old, err := credentialRepo.UseRefreshToken(r.Context(), hashToken(req.RefreshToken), time.Now())
+	switch {
+	case errors.Is(err, ErrTokenReused):
+		slog.WarnContext(r.Context(), "refresh token reused, revoking all sessions", "user_id", old.UserID)
+		writeInvalidCredentials(w, "invalid refresh token")
+		return
+	case errors.Is(err, ErrNotFound):
+		writeInvalidCredentials(w, "invalid refresh token")
+		return
+	case err != nil:
+		writeStoreError(w, r, err)
+		return
+	}
+
+	u, err := userRepo.Get(r.Context(), old.UserID)
+	if errors.Is(err, ErrNotFound) {
+		writeInvalidCredentials(w, "invalid refresh token")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeTokens(w, r, u)
+}
+
+// logout revokes a refresh token. Access tokens already issued stay valid
+// until they expire, which is why they are short-lived.
+func logout(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := credentialRepo.RevokeRefreshToken(r.Context(), hashToken(req.RefreshToken)); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changePassword sets a new password after checking the current one, and
+// ends every session of the user.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("id")
+	if c := authz.From(r); !c.CanWrite(userID) {
+		authz.Forbid(w, r, c, "password of another user")
+		return
+	}
+
+	var req passwordChange
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if _, err := userRepo.Get(r.Context(), userID); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if problem := validatePassword(req.NewPassword); problem != "" {
+		writeValidationError(w, map[string]string{"new_password": problem})
+		return
+	}
+
+	hash, err := credentialRepo.Password(r.Context(), userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err != nil || !checkPassword(hash, req.CurrentPassword) {
+		httpjson.Error(w, http.StatusForbidden, "current password is incorrect")
+		return
+	}
+
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err := credentialRepo.SetPassword(r.Context(), userID, newHash); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err := credentialRepo.RevokeRefreshTokens(r.Context(), userID); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "password changed", "user_id", userID)
+	w.WriteHeader(http.StatusNoContent)
+}
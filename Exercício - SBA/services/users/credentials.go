@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"platform/journal"
+)
+
+// ErrTokenReused is returned when a refresh token is presented again after
+// being exchanged. That only happens when the token leaked, so every refresh
+// token of the user is revoked.
+var ErrTokenReused = errors.New("refresh token reused")
+
+// Credential is the password of a user. It is kept apart from User so the
+// hash can never end up in a users response.
+type Credential struct {
+	UserID       string    `json:"user_id"`
+	PasswordHash string    `json:"password_hash"`
+	ChangedAt    time.Time `json:"changed_at"`
+}
+
+// RefreshToken is an issued refresh token. Only the SHA-256 hash of the
+// token is stored; the token itself is known to the client alone.
+type RefreshToken struct {
+	Hash      string    `json:"hash"`
+	UserID    string    `json:"user_id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Used is set once the token has been exchanged for a new one.
+	Used    bool `json:"used,omitempty"`
+	Revoked bool `json:"revoked,omitempty"`
+}
+
+// CredentialRepository stores passwords and refresh tokens.
+type CredentialRepository interface {
+	// Password returns the password hash of a user, or ErrNotFound.
+	Password(ctx context.Context, userID string) (string, error)
+	SetPassword(ctx context.Context, userID, hash string) error
+	// RemoveUser deletes the password and refresh tokens of a user.
+	RemoveUser(ctx context.Context, userID string) error
+	AddRefreshToken(ctx context.Context, t RefreshToken) error
+	// UseRefreshToken marks the token with the given hash as used and
+	// returns it. Unknown, expired and revoked tokens give ErrNotFound; a
+	// token used before gives ErrTokenReused, along with the token.
+	UseRefreshToken(ctx context.Context, hash string, now time.Time) (RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, hash string) error
+	// RevokeRefreshTokens revokes every refresh token of a user.
+	RevokeRefreshTokens(ctx context.Context, userID string) error
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// openCredentialRepository builds the credential storage matching driver.
+// The file driver keeps passwords at passwordsPath and refresh tokens at
+// tokensPath.
+func openCredentialRepository(driver, passwordsPath, tokensPath string) (CredentialRepository, error) {
+	switch driver {
+	case "memory":
+		return newMemoryCredentialRepository(), nil
+	case "file":
+		return openFileCredentialRepository(passwordsPath, tokensPath)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q (want memory or file)", driver)
+	}
+}
+
+// memoryCredentialRepository keeps credentials in maps guarded by a mutex.
+type memoryCredentialRepository struct {
+	mu        sync.Mutex
+	passwords map[string]Credential   // by user ID
+	tokens    map[string]RefreshToken // by token hash
+	// persistPassword and persistToken, when set, are called with every
+	// change before it is applied; if they fail the change is dropped.
+	persistPassword func(journal.Entry[Credential]) error
+	persistToken    func(journal.Entry[RefreshToken]) error
+}
+
+func newMemoryCredentialRepository() *memoryCredentialRepository {
+	return &memoryCredentialRepository{passwords: map[string]Credential{}, tokens: map[string]RefreshToken{}}
+}
+
+// commitPassword persists and applies a password change. Callers must hold mu.
+func (m *memoryCredentialRepository) commitPassword(entry journal.Entry[Credential]) error {
+	if m.persistPassword != nil {
+		if err := m.persistPassword(entry); err != nil {
+			return fmt.Errorf("persisting password of user %s: %w", entry.ID, err)
+		}
+	}
+	if entry.Op == "delete" {
+		delete(m.passwords, entry.ID)
+	} else {
+		m.passwords[entry.ID] = *entry.Record
+	}
+	return nil
+}
+
+// commitToken persists and applies a refresh token change. Callers must
+// hold mu.
+func (m *memoryCredentialRepository) commitToken(entry journal.Entry[RefreshToken]) error {
+	if m.persistToken != nil {
+		if err := m.persistToken(entry); err != nil {
+			return fmt.Errorf("persisting refresh token: %w", err)
+		}
+	}
+	if entry.Op == "delete" {
+		delete(m.tokens, entry.ID)
+	} else {
+		m.tokens[entry.ID] = *entry.Record
+	}
+	return nil
+}
+
+// userTokens returns the hashes of the tokens of userID, in a stable order.
+// Callers must hold mu.
+func (m *memoryCredentialRepository) userTokens(userID string) []string {
+	var hashes []string
+	for hash, t := range m.tokens {
+		if t.UserID == userID {
+			hashes = append(hashes, hash)
+		}
+	}
+	slices.Sort(hashes)
+	return hashes
+}
+
+// pruneTokens drops the tokens that expired before now. Callers must hold mu.
+func (m *memoryCredentialRepository) pruneTokens(now time.Time) error {
+	for _, hash := range slices.Sorted(maps.Keys(m.tokens)) {
+		if m.tokens[hash].ExpiresAt.Before(now) {
+			if err := m.commitToken(journal.Entry[RefreshToken]{Op: "delete", ID: hash}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memoryCredentialRepository) Password(ctx context.Context, userID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.passwords[userID]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return c.PasswordHash, nil
+}
+
+func (m *memoryCredentialRepository) SetPassword(ctx context.Context, userID, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := Credential{UserID: userID, PasswordHash: hash, ChangedAt: time.Now().UTC()}
+	return m.commitPassword(journal.Entry[Credential]{Op: "put", ID: userID, Record: &c})
+}
+
+func (m *memoryCredentialRepository) RemoveUser(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, hash := range m.userTokens(userID) {
+		if err := m.commitToken(journal.Entry[RefreshToken]{Op: "delete", ID: hash}); err != nil {
+			return err
+		}
+	}
+	if _, ok := m.passwords[userID]; !ok {
+		return nil
+	}
+	return m.commitPassword(journal.Entry[Credential]{Op: "delete", ID: userID})
+}
+
+func (m *memoryCredentialRepository) AddRefreshToken(ctx context.Context, t RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Expired tokens are useless; dropping them here keeps the store small.
+	if err := m.pruneTokens(t.IssuedAt); err != nil {
+		return err
+	}
+	return m.commitToken(journal.Entry[RefreshToken]{Op: "put", ID: t.Hash, Record: &t})
+}
+
+func (m *memoryCredentialRepository) UseRefreshToken(ctx context.Context, hash string, now time.Time) (RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[hash]
+	if !ok || t.Revoked || now.After(t.ExpiresAt) {
+		return RefreshToken{}, ErrNotFound
+	}
+	if t.Used {
+		if err := m.revokeAll(t.UserID); err != nil {
+			return RefreshToken{}, err
+		}
+		return t, ErrTokenReused
+	}
+	t.Used = true
+	if err := m.commitToken(journal.Entry[RefreshToken]{Op: "put", ID: hash, Record: &t}); err != nil {
+		return RefreshToken{}, err
+	}
+	return t, nil
+}
+
+func (m *memoryCredentialRepository) RevokeRefreshToken(ctx context.Context, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.tokens[hash]
+	if !ok || t.Revoked {
+		return nil
+	}
+	t.Revoked = true
+	return m.commitToken(journal.Entry[RefreshToken]{Op: "put", ID: hash, Record: &t})
+}
+
+func (m *memoryCredentialRepository) RevokeRefreshTokens(ctx context.Context, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.revokeAll(userID)
+}
+
+// revokeAll revokes every token of userID. Callers must hold mu.
+func (m *memoryCredentialRepository) revokeAll(userID string) error {
+	for _, hash := range m.userTokens(userID) {
+		t := m.tokens[hash]
+		if t.Revoked {
+			continue
+		}
+		t.Revoked = true
+		if err := m.commitToken(journal.Entry[RefreshToken]{Op: "put", ID: hash, Record: &t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryCredentialRepository) Ping(ctx context.Context) error { return nil }
+
+func (m *memoryCredentialRepository) Close() error { return nil }
+
+// fileCredentialRepository is a memoryCredentialRepository whose changes are
+// recorded in two journal files, one for passwords and one for refresh
+// tokens.
+type fileCredentialRepository struct {
+	*memoryCredentialRepository
+	passwordJournal *journal.Journal[Credential]
+	tokenJournal    *journal.Journal[RefreshToken]
+}
+
+// openFileCredentialRepository loads the credentials stored at the given
+// paths, dropping expired refresh tokens while compacting.
+func openFileCredentialRepository(passwordPath, tokenPath string) (*fileCredentialRepository, error) {
+	m := newMemoryCredentialRepository()
+	pj, _, err := journal.Open(passwordPath, func(entry journal.Entry[Credential]) {
+		if entry.Op == "delete" {
+			delete(m.passwords, entry.ID)
+		} else if entry.Record != nil {
+			m.passwords[entry.ID] = *entry.Record
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	tj, _, err := journal.Open(tokenPath, func(entry journal.Entry[RefreshToken]) {
+		if entry.Op == "delete" {
+			delete(m.tokens, entry.ID)
+		} else if entry.Record != nil {
+			m.tokens[entry.ID] = *entry.Record
+		}
+	})
+	if err != nil {
+		pj.Close()
+		return nil, err
+	}
+
+	var passwords []journal.Entry[Credential]
+	for _, id := range slices.Sorted(maps.Keys(m.passwords)) {
+		c := m.passwords[id]
+		passwords = append(passwords, journal.Entry[Credential]{Op: "put", ID: id, Record: &c})
+	}
+	now := time.Now()
+	var tokens []journal.Entry[RefreshToken]
+	for _, hash := range slices.Sorted(maps.Keys(m.tokens)) {
+		t := m.tokens[hash]
+		if t.ExpiresAt.Before(now) {
+			delete(m.tokens, hash)
+			continue
+		}
+		tokens = append(tokens, journal.Entry[RefreshToken]{Op: "put", ID: hash, Record: &t})
+	}
+	if err := pj.Compact(passwords); err != nil {
+		pj.Close()
+		tj.Close()
+		return nil, err
+	}
+	if err := tj.Compact(tokens); err != nil {
+		pj.Close()
+		tj.Close()
+		return nil, err
+	}
+
+	m.persistPassword, m.persistToken = pj.Append, tj.Append
+	return &fileCredentialRepository{memoryCredentialRepository: m, passwordJournal: pj, tokenJournal: tj}, nil
+}
+
+func (f *fileCredentialRepository) Ping(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.passwordJournal.Check(); err != nil {
+		return err
+	}
+	return f.tokenJournal.Check()
+}
+
+func (f *fileCredentialRepository) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return errors.Join(f.passwordJournal.Close(), f.tokenJournal.Close())
+}
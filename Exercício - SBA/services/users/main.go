@@ -1,49 +1,433 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/mail"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"platform/authz"
+	"platform/conditional"
+	"platform/discovery"
+	"platform/health"
+	"platform/httpjson"
+	"platform/server"
+	"platform/telemetry"
+)
+
+// serviceName and serviceVersion are reported by /health and /ready and
+// announced to the registry.
+const (
+	serviceName    = "users"
+	serviceVersion = "1.0.0"
 )
 
 type User struct {
 	ID    string `json:"id"`
 	Name  string `json:"name"`
 	Email string `json:"email"`
+	// Role is customer, support or admin; it decides what the user may
+	// access and is only changed by admin.
+	Role string `json:"role"`
+	// Version counts the changes made to the user and, with UpdatedAt,
+	// forms its ETag; both are maintained by the repository.
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-var users = []User{
-	{ID: "1", Name: "João Silva", Email: "joao@example.com"},
-	{ID: "2", Name: "Maria Santos", Email: "maria@example.com"},
-	{ID: "3", Name: "Pedro Costa", Email: "pedro@example.com"},
+// etag is the entity tag of the user's current version.
+func (u User) etag() string { return conditional.EntityTag(u.Version, u.UpdatedAt) }
+
+// userInput is the body accepted by create and update requests. Fields are
+// pointers so PATCH can tell "not sent" apart from "sent empty". Password is
+// only accepted on create; it is changed through PUT /user/password.
+type userInput struct {
+	Name     *string `json:"name"`
+	Email    *string `json:"email"`
+	Role     *string `json:"role"`
+	Password *string `json:"password"`
+}
+
+// roles lists the valid values of User.Role.
+var roles = []string{authz.RoleCustomer, authz.RoleSupport, authz.RoleAdmin}
+
+const maxNameLength = 100
+
+// userRepo holds every user; it is chosen at startup by openUserRepository.
+var userRepo UserRepository
+
+// writeValidationError reports which fields failed validation.
+func writeValidationError(w http.ResponseWriter, fields map[string]string) {
+	httpjson.Write(w, http.StatusUnprocessableEntity, map[string]any{
+		"error":  "validation failed",
+		"fields": fields,
+	})
+}
+
+// decodeJSON reads the request body into v, rejecting unknown fields and
+// trailing data. On failure a 400 has been written.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		httpjson.Error(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	if dec.More() {
+		httpjson.Error(w, http.StatusBadRequest, "invalid JSON body: unexpected data after object")
+		return false
+	}
+	return true
+}
+
+// decodeInput reads a userInput from the request body.
+func decodeInput(w http.ResponseWriter, r *http.Request) (userInput, bool) {
+	var in userInput
+	return in, decodeJSON(w, r, &in)
+}
+
+// normalizeEmail trims and lowercases an address so uniqueness checks are
+// case-insensitive.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// validateUser checks a complete user record and returns the offending fields.
+func validateUser(u User) map[string]string {
+	fields := map[string]string{}
+
+	switch n := utf8.RuneCountInString(u.Name); {
+	case strings.TrimSpace(u.Name) == "":
+		fields["name"] = "name is required"
+	case n > maxNameLength:
+		fields["name"] = "name must be at most " + strconv.Itoa(maxNameLength) + " characters"
+	}
+
+	if u.Email == "" {
+		fields["email"] = "email is required"
+	} else if addr, err := mail.ParseAddress(u.Email); err != nil || addr.Address != u.Email ||
+		!strings.Contains(u.Email[strings.LastIndex(u.Email, "@")+1:], ".") {
+		fields["email"] = "email must be a valid address such as name@example.com"
+	}
+
+	if !slices.Contains(roles, u.Role) {
+		fields["role"] = "role must be one of " + strings.Join(roles, ", ")
+	}
+
+	return fields
+}
+
+// applyInput copies the fields sent in in onto u, normalizes them and
+// validates the result.
+func applyInput(u *User, in userInput) error {
+	if in.Name != nil {
+		u.Name = *in.Name
+	}
+	if in.Email != nil {
+		u.Email = *in.Email
+	}
+	if in.Role != nil {
+		u.Role = *in.Role
+	}
+	if u.Role == "" {
+		u.Role = authz.RoleCustomer
+	}
+	u.Name = strings.TrimSpace(u.Name)
+	u.Email = normalizeEmail(u.Email)
+	if fields := validateUser(*u); len(fields) > 0 {
+		return validationError(fields)
+	}
+	return nil
+}
+
+// validationError carries the per-field messages of a rejected user.
+type validationError map[string]string
+
+func (v validationError) Error() string { return "validation failed" }
+
+// writeStoreError maps repository and validation errors to responses.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid validationError
+	switch {
+	case errors.As(err, &invalid):
+		writeValidationError(w, invalid)
+	case errors.Is(err, ErrNotFound):
+		httpjson.Error(w, http.StatusNotFound, "User not found")
+	case errors.Is(err, ErrEmailTaken):
+		httpjson.Error(w, http.StatusConflict, err.Error())
+	default:
+		slog.ErrorContext(r.Context(), "storage error", "error", err)
+		httpjson.Error(w, http.StatusInternalServerError, "storage error")
+	}
 }
 
 func getUsers(w http.ResponseWriter, r *http.Request) {
-	log.Println("[USERS SERVICE] GET /users")
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	if c := authz.From(r); !c.CanReadAll() {
+		authz.Forbid(w, r, c, "only support and admin may list every user")
+		return
+	}
+	users, err := userRepo.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, users)
 }
 
 func getUserByID(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("id")
-	log.Printf("[USERS SERVICE] GET /user?id=%s\n", userID)
+	if c := authz.From(r); !c.CanRead(userID) {
+		authz.Forbid(w, r, c, "profile of another user")
+		return
+	}
 
-	for _, user := range users {
-		if user.ID == userID {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(user)
-			return
+	user, err := userRepo.Get(r.Context(), userID)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	conditional.SetValidators(w, user.etag(), user.UpdatedAt)
+	if conditional.NotModified(w, r, user.etag(), user.UpdatedAt) {
+		return
+	}
+	httpjson.Write(w, http.StatusOK, user)
+}
+
+func createUser(w http.ResponseWriter, r *http.Request) {
+	if c := authz.From(r); !c.CanWriteAll() {
+		authz.Forbid(w, r, c, "only admin may create users")
+		return
+	}
+
+	in, ok := decodeInput(w, r)
+	if !ok {
+		return
+	}
+	var user User
+	err := applyInput(&user, in)
+	var fields validationError
+	if err != nil && !errors.As(err, &fields) {
+		writeStoreError(w, r, err)
+		return
+	}
+	if fields == nil {
+		fields = validationError{}
+	}
+	if in.Password == nil {
+		fields["password"] = "password is required"
+	} else if problem := validatePassword(*in.Password); problem != "" {
+		fields["password"] = problem
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, fields)
+		return
+	}
+
+	hash, err := hashPassword(*in.Password)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	created, err := userRepo.Create(r.Context(), user)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err := credentialRepo.SetPassword(r.Context(), created.ID, hash); err != nil {
+		// Without a password the account could never log in; undo it.
+		if delErr := userRepo.Delete(r.Context(), created.ID); delErr != nil {
+			slog.ErrorContext(r.Context(), "removing user after failed password save", "user_id", created.ID, "error", delErr)
 		}
+		writeStoreError(w, r, err)
+		return
+	}
+	slog.InfoContext(r.Context(), "user created", "user_id", created.ID)
+	w.Header().Set("Location", "/user?id="+created.ID)
+	conditional.SetValidators(w, created.etag(), created.UpdatedAt)
+	httpjson.Write(w, http.StatusCreated, created)
+}
+
+// updateUser replaces a user (PUT) or changes only the fields sent (PATCH).
+// The role is kept unless sent, even on PUT, and only admin may change it.
+// If-Match must carry the ETag of the version being changed, so concurrent
+// edits fail with 412 instead of overwriting each other.
+func updateUser(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("id")
+	c := authz.From(r)
+	if !c.CanWrite(userID) {
+		authz.Forbid(w, r, c, "profile of another user")
+		return
+	}
+	ifMatch, ok := conditional.RequireIfMatch(w, r)
+	if !ok {
+		return
 	}
 
-	http.Error(w, "User not found", http.StatusNotFound)
+	in, ok := decodeInput(w, r)
+	if !ok {
+		return
+	}
+	if in.Role != nil && !c.CanWriteAll() {
+		authz.Forbid(w, r, c, "only admin may change roles")
+		return
+	}
+	if in.Password != nil {
+		writeValidationError(w, map[string]string{"password": "use PUT /user/password to change the password"})
+		return
+	}
+
+	var current string
+	updated, err := userRepo.Update(r.Context(), userID, func(u *User) error {
+		current = u.etag()
+		if err := conditional.CheckIfMatch(ifMatch, current); err != nil {
+			return err
+		}
+		if r.Method == http.MethodPut {
+			u.Name, u.Email = "", ""
+		}
+		return applyInput(u, in)
+	})
+	if errors.Is(err, conditional.ErrPreconditionFailed) {
+		conditional.WritePreconditionFailed(w, current)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	conditional.SetValidators(w, updated.etag(), updated.UpdatedAt)
+	httpjson.Write(w, http.StatusOK, updated)
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	userID := r.URL.Query().Get("id")
+	if c := authz.From(r); !c.CanWriteAll() {
+		authz.Forbid(w, r, c, "only admin may delete users")
+		return
+	}
+
+	if err := userRepo.Delete(r.Context(), userID); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if err := credentialRepo.RemoveUser(r.Context(), userID); err != nil {
+		slog.ErrorContext(r.Context(), "removing credentials", "user_id", userID, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerUserMetrics exposes the number of users with each role on
+// /metrics, counted from the repository at every scrape.
+func registerUserMetrics() {
+	telemetry.NewCollected("users", "Registered users with each role.", "gauge", []string{"role"}, func(emit func(float64, ...string)) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		users, err := userRepo.List(ctx)
+		if err != nil {
+			slog.Error("collecting user metrics", "error", err)
+			return
+		}
+		counts := map[string]int{}
+		for _, u := range users {
+			counts[u.Role]++
+		}
+		for _, role := range roles {
+			emit(float64(counts[role]), role)
+		}
+	})
 }
 
 func main() {
-	http.HandleFunc("/users", getUsers)
-	http.HandleFunc("/user", getUserByID)
+	srvFlags := server.DefineFlags(":8081")
+	driver := server.EnvString("storage", "STORAGE_DRIVER", "memory", "storage driver: memory or file")
+	storagePath := server.EnvString("storage-path", "STORAGE_PATH", "data/users.jsonl", "journal of the file storage")
+	credentialsPath := server.EnvString("credentials-path", "CREDENTIALS_PATH", "data/credentials.jsonl", "credentials journal of the file storage")
+	tokensPath := server.EnvString("refresh-tokens-path", "REFRESH_TOKENS_PATH", "data/refresh_tokens.jsonl", "refresh token journal of the file storage")
+	auditPath := server.EnvString("audit-log", "AUDIT_LOG", "data/audit.jsonl", "file the denied requests are recorded in")
+	registry := server.EnvString("registry", "REGISTRY_URL", "", "service registry to register with")
+	logLevel := server.EnvString("log-level", "LOG_LEVEL", "info", "debug, info, warn or error")
+	flagErr := server.ParseFlags()
+	if err := telemetry.InitLogging(serviceName, *logLevel); err != nil {
+		log.Fatalf("[USERS SERVICE] Logging: %v\n", err)
+	}
+	if flagErr != nil {
+		telemetry.Fatal("invalid settings", "error", flagErr)
+	}
+	flushTraces, err := telemetry.InitTracing(serviceName)
+	if err != nil {
+		telemetry.Fatal("setting up tracing", "error", err)
+	}
+	defer flushTraces()
+
+	if tokens, err = newTokenIssuer(); err != nil {
+		telemetry.Fatal("reading token settings", "error", err)
+	}
+
+	storageDriver = *driver
+	repo, err := openUserRepository(*driver, *storagePath)
+	if err != nil {
+		telemetry.Fatal("opening storage", "error", err)
+	}
+	defer repo.Close()
+	userRepo = tracedUserRepository{repo}
+
+	creds, err := openCredentialRepository(*driver, *credentialsPath, *tokensPath)
+	if err != nil {
+		telemetry.Fatal("opening credential storage", "error", err)
+	}
+	defer creds.Close()
+	credentialRepo = tracedCredentialRepository{creds}
+	if err := authz.OpenAuditLog(serviceName, *auditPath); err != nil {
+		telemetry.Fatal("opening audit log", "error", err)
+	}
+	if err := authz.LoadServiceToken(); err != nil {
+		telemetry.Fatal("reading the service token", "error", err)
+	}
+	if err := seedCredentials(context.Background(), os.Getenv("SEED_PASSWORD")); err != nil {
+		telemetry.Fatal("setting seed passwords", "error", err)
+	}
+
+	http.HandleFunc("GET /users", getUsers)
+	http.HandleFunc("POST /users", createUser)
+	http.HandleFunc("GET /user", getUserByID)
+	http.HandleFunc("PUT /user", updateUser)
+	http.HandleFunc("PATCH /user", updateUser)
+	http.HandleFunc("DELETE /user", deleteUser)
+	http.HandleFunc("PUT /user/password", changePassword)
+	http.HandleFunc("POST /auth/login", login)
+	http.HandleFunc("POST /auth/refresh", refresh)
+	http.HandleFunc("POST /auth/logout", logout)
+	status := health.Service{
+		Name:    serviceName,
+		Version: serviceVersion,
+		Driver:  storageDriver,
+		Checks: map[string]func(context.Context) error{
+			"storage":     userRepo.Ping,
+			"credentials": credentialRepo.Ping,
+		},
+	}
+	http.HandleFunc("GET /health", status.Liveness)
+	http.HandleFunc("GET /ready", status.Readiness)
+	http.HandleFunc("GET /metrics", telemetry.ServeMetrics)
+	registerUserMetrics()
 
-	port := ":8081"
-	log.Printf("[USERS SERVICE] Started on port %s\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	deregister, err := discovery.Register(*registry, serviceName, serviceVersion, *srvFlags.Addr, nil)
+	if err != nil {
+		telemetry.Fatal("registering with the service registry", "error", err)
+	}
+	slog.Info("started", "addr", *srvFlags.Addr)
+	srv := srvFlags.Server(telemetry.Handler(http.DefaultServeMux))
+	if err := server.Serve(srv, *srvFlags.ShutdownTimeout, deregister); err != nil {
+		telemetry.Fatal("server stopped", "error", err)
+	}
+	slog.Info("stopped")
 }
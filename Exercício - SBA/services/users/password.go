@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Password hashing parameters: PBKDF2 with HMAC-SHA256 and the iteration
+// count recommended by OWASP. The count is stored with every hash, so it can
+// be raised later without invalidating existing passwords.
+const (
+	pbkdf2Iterations = 600_000
+	saltLength       = 16
+	derivedKeyLength = 32
+	hashScheme       = "pbkdf2-sha256"
+)
+
+// Password length limits, in characters.
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+)
+
+// hashPassword derives a salted hash of password, encoded as
+// "pbkdf2-sha256$<iterations>$<salt>$<key>".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, derivedKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", hashScheme, pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash made by
+// hashPassword. The comparison takes the same time wherever they differ.
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != hashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyHash is checked against when the login email is unknown, so that
+// the answer takes as long as for a wrong password and does not reveal which
+// emails are registered.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword("dummy password")
+	return hash
+})
+
+// validatePassword returns the problem with a new password, or "".
+func validatePassword(password string) string {
+	switch n := utf8.RuneCountInString(password); {
+	case n < minPasswordLength:
+		return "password must be at least " + strconv.Itoa(minPasswordLength) + " characters"
+	case n > maxPasswordLength:
+		return "password must be at most " + strconv.Itoa(maxPasswordLength) + " characters"
+	}
+	return ""
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"platform/authz"
+	"platform/journal"
+)
+
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrEmailTaken = errors.New("email already in use")
+)
+
+// UserRepository is the storage used by the HTTP handlers.
+type UserRepository interface {
+	List(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id string) (User, error)
+	// GetByEmail finds a user by normalized email address.
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// Create assigns a new ID to u and stores it at version 1.
+	Create(ctx context.Context, u User) (User, error)
+	// Update loads the user, lets mutate change it and stores the result
+	// atomically as the next version. An error from mutate aborts the
+	// update and is returned.
+	Update(ctx context.Context, id string, mutate func(*User) error) (User, error)
+	Delete(ctx context.Context, id string) error
+	// Ping reports whether the storage is usable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+var seedUsers = []User{
+	{ID: "1", Name: "João Silva", Email: "joao@example.com", Role: authz.RoleAdmin},
+	{ID: "2", Name: "Maria Santos", Email: "maria@example.com", Role: authz.RoleCustomer},
+	{ID: "3", Name: "Pedro Costa", Email: "pedro@example.com", Role: authz.RoleSupport},
+}
+
+// storageDriver names the storage in use, for /ready and storage spans.
+var storageDriver string
+
+// openUserRepository builds the repository selected by driver ("memory" or
+// "file"). The file driver keeps its journal at path.
+func openUserRepository(driver, path string) (UserRepository, error) {
+	switch driver {
+	case "memory":
+		return newMemoryUserRepository(seedUsers), nil
+	case "file":
+		return openFileUserRepository(path, seedUsers)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q (want memory or file)", driver)
+	}
+}
+
+// envOr returns the environment variable key, or fallback when it is unset.
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// memoryUserRepository keeps users in a slice guarded by a mutex.
+type memoryUserRepository struct {
+	mu     sync.RWMutex
+	users  []User
+	lastID int
+	// persist, when set, is called with every change before it is applied;
+	// if it fails the change is dropped.
+	persist func(journal.Entry[User]) error
+}
+
+func newMemoryUserRepository(seed []User) *memoryUserRepository {
+	m := &memoryUserRepository{}
+	for _, u := range seed {
+		m.put(u)
+	}
+	return m
+}
+
+// put inserts or replaces u. Callers must hold mu for writing.
+func (m *memoryUserRepository) put(u User) {
+	m.noteID(u.ID)
+	// Users stored before roles existed are customers, and users stored
+	// before versions existed start at version 1.
+	if u.Role == "" {
+		u.Role = authz.RoleCustomer
+	}
+	if u.Version == 0 {
+		u.Version, u.UpdatedAt = 1, time.Now().UTC()
+	}
+	if i := m.index(u.ID); i >= 0 {
+		m.users[i] = u
+		return
+	}
+	m.users = append(m.users, u)
+}
+
+// remove deletes the user with the given ID. Callers must hold mu for writing.
+func (m *memoryUserRepository) remove(id string) {
+	m.noteID(id)
+	if i := m.index(id); i >= 0 {
+		m.users = slices.Delete(m.users, i, i+1)
+	}
+}
+
+// noteID keeps lastID at the highest numeric ID ever seen, including deleted
+// ones. Callers must hold mu for writing.
+func (m *memoryUserRepository) noteID(id string) {
+	if n, err := strconv.Atoi(id); err == nil && n > m.lastID {
+		m.lastID = n
+	}
+}
+
+// index returns the position of the user with the given ID, or -1.
+// Callers must hold mu.
+func (m *memoryUserRepository) index(id string) int {
+	return slices.IndexFunc(m.users, func(u User) bool { return u.ID == id })
+}
+
+// emailTaken reports whether a user other than exceptID uses email.
+// Callers must hold mu.
+func (m *memoryUserRepository) emailTaken(email, exceptID string) bool {
+	return slices.ContainsFunc(m.users, func(u User) bool { return u.ID != exceptID && u.Email == email })
+}
+
+// commit persists a change (if a journal is attached) and then applies it.
+// Callers must hold mu for writing.
+func (m *memoryUserRepository) commit(entry journal.Entry[User]) error {
+	if m.persist != nil {
+		if err := m.persist(entry); err != nil {
+			return fmt.Errorf("persisting user %s: %w", entry.ID, err)
+		}
+	}
+	if entry.Op == "delete" {
+		m.remove(entry.ID)
+	} else {
+		m.put(*entry.Record)
+	}
+	return nil
+}
+
+func (m *memoryUserRepository) List(ctx context.Context) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return slices.Clone(m.users), nil
+}
+
+func (m *memoryUserRepository) Get(ctx context.Context, id string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i := m.index(id); i >= 0 {
+		return m.users[i], nil
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *memoryUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i := slices.IndexFunc(m.users, func(u User) bool { return u.Email == email }); i >= 0 {
+		return m.users[i], nil
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *memoryUserRepository) Create(ctx context.Context, u User) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.emailTaken(u.Email, "") {
+		return User{}, ErrEmailTaken
+	}
+	// IDs are never reused, even after a delete, so stale references in
+	// other services cannot point at a new user.
+	u.ID = strconv.Itoa(m.lastID + 1)
+	u.Version, u.UpdatedAt = 1, time.Now().UTC()
+	if err := m.commit(journal.Entry[User]{Op: "put", ID: u.ID, Record: &u}); err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+func (m *memoryUserRepository) Update(ctx context.Context, id string, mutate func(*User) error) (User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.index(id)
+	if i < 0 {
+		return User{}, ErrNotFound
+	}
+	u := m.users[i]
+	if err := mutate(&u); err != nil {
+		return User{}, err
+	}
+	u.ID = id
+	if m.emailTaken(u.Email, id) {
+		return User{}, ErrEmailTaken
+	}
+	u.Version, u.UpdatedAt = m.users[i].Version+1, time.Now().UTC()
+	if err := m.commit(journal.Entry[User]{Op: "put", ID: id, Record: &u}); err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+func (m *memoryUserRepository) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.index(id) < 0 {
+		return ErrNotFound
+	}
+	return m.commit(journal.Entry[User]{Op: "delete", ID: id})
+}
+
+func (m *memoryUserRepository) Ping(ctx context.Context) error { return nil }
+
+func (m *memoryUserRepository) Close() error { return nil }
+
+// fileUserRepository is a memoryUserRepository whose changes are recorded in
+// a journal file, so the data survives restarts.
+type fileUserRepository struct {
+	*memoryUserRepository
+	journal *journal.Journal[User]
+}
+
+// openFileUserRepository loads the users stored at path. A new file is
+// started with the seed users.
+func openFileUserRepository(path string, seed []User) (*fileUserRepository, error) {
+	m := &memoryUserRepository{}
+	j, existed, err := journal.Open(path, func(entry journal.Entry[User]) {
+		if entry.Op == "delete" {
+			m.remove(entry.ID)
+		} else if entry.Record != nil {
+			m.put(*entry.Record)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !existed {
+		for _, u := range seed {
+			m.put(u)
+		}
+	}
+
+	snapshot := make([]journal.Entry[User], len(m.users))
+	for i := range m.users {
+		snapshot[i] = journal.Entry[User]{Op: "put", ID: m.users[i].ID, Record: &m.users[i]}
+	}
+	// Keep a tombstone for the highest ID so it is not handed out again.
+	if lastID := strconv.Itoa(m.lastID); m.lastID > 0 && m.index(lastID) < 0 {
+		snapshot = append(snapshot, journal.Entry[User]{Op: "delete", ID: lastID})
+	}
+	if err := j.Compact(snapshot); err != nil {
+		j.Close()
+		return nil, err
+	}
+
+	m.persist = j.Append
+	return &fileUserRepository{memoryUserRepository: m, journal: j}, nil
+}
+
+func (f *fileUserRepository) Ping(ctx context.Context) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.journal.Check()
+}
+
+func (f *fileUserRepository) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.journal.Close()
+}
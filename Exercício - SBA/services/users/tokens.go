@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// minSecretLength is the shortest HS256 secret accepted, the size of the
+// SHA-256 output (RFC 7518, section 3.2).
+const minSecretLength = 32
+
+// tokenIssuer signs the access tokens verified by the gateway and creates
+// refresh tokens.
+type tokenIssuer struct {
+	secret     []byte
+	issuer     string
+	audience   string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// newTokenIssuer reads the token settings from the environment: JWT_SECRET
+// (required, shared with the gateway), JWT_ISSUER, JWT_AUDIENCE,
+// ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL.
+func newTokenIssuer() (*tokenIssuer, error) {
+	t := &tokenIssuer{
+		secret:   []byte(os.Getenv("JWT_SECRET")),
+		issuer:   envOr("JWT_ISSUER", "sba-users"),
+		audience: envOr("JWT_AUDIENCE", "sba-api"),
+	}
+	if len(t.secret) < minSecretLength {
+		return nil, fmt.Errorf("JWT_SECRET must hold a secret of at least %d bytes", minSecretLength)
+	}
+	var err error
+	if t.accessTTL, err = time.ParseDuration(envOr("ACCESS_TOKEN_TTL", "15m")); err != nil || t.accessTTL <= 0 {
+		return nil, fmt.Errorf("invalid ACCESS_TOKEN_TTL: %v", err)
+	}
+	if t.refreshTTL, err = time.ParseDuration(envOr("REFRESH_TOKEN_TTL", "168h")); err != nil || t.refreshTTL <= 0 {
+		return nil, fmt.Errorf("invalid REFRESH_TOKEN_TTL: %v", err)
+	}
+	return t, nil
+}
+
+// accessClaims are the claims of an access token.
+type accessClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud"`
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	ExpiresAt int64    `json:"exp"`
+	ID        string   `json:"jti"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+}
+
+// accessToken returns a signed HS256 JWT for u, valid for accessTTL.
+func (t *tokenIssuer) accessToken(u User, now time.Time) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(accessClaims{
+		Issuer:    t.issuer,
+		Subject:   u.ID,
+		Audience:  t.audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(t.accessTTL).Unix(),
+		ID:        jti,
+		Email:     u.Email,
+		Roles:     []string{u.Role},
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// randomToken returns n random bytes encoded as base64url.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is the form in which refresh tokens are stored. The tokens are
+// random, so a plain SHA-256 is enough to make a leaked store useless.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"platform/telemetry"
+)
+
+// tracedUserRepository records a span for every call to a UserRepository.
+type tracedUserRepository struct{ UserRepository }
+
+func (t tracedUserRepository) List(ctx context.Context) ([]User, error) {
+	return telemetry.TraceStorage(ctx, "UserRepository.List", storageDriver, ErrNotFound, t.UserRepository.List)
+}
+
+func (t tracedUserRepository) Get(ctx context.Context, id string) (User, error) {
+	return telemetry.TraceStorage(ctx, "UserRepository.Get", storageDriver, ErrNotFound, func(ctx context.Context) (User, error) {
+		return t.UserRepository.Get(ctx, id)
+	})
+}
+
+func (t tracedUserRepository) GetByEmail(ctx context.Context, email string) (User, error) {
+	return telemetry.TraceStorage(ctx, "UserRepository.GetByEmail", storageDriver, ErrNotFound, func(ctx context.Context) (User, error) {
+		return t.UserRepository.GetByEmail(ctx, email)
+	})
+}
+
+func (t tracedUserRepository) Create(ctx context.Context, u User) (User, error) {
+	return telemetry.TraceStorage(ctx, "UserRepository.Create", storageDriver, ErrNotFound, func(ctx context.Context) (User, error) {
+		return t.UserRepository.Create(ctx, u)
+	})
+}
+
+func (t tracedUserRepository) Update(ctx context.Context, id string, mutate func(*User) error) (User, error) {
+	return telemetry.TraceStorage(ctx, "UserRepository.Update", storageDriver, ErrNotFound, func(ctx context.Context) (User, error) {
+		return t.UserRepository.Update(ctx, id, mutate)
+	})
+}
+
+func (t tracedUserRepository) Delete(ctx context.Context, id string) error {
+	return telemetry.TraceStorageErr(ctx, "UserRepository.Delete", storageDriver, ErrNotFound, func(ctx context.Context) error {
+		return t.UserRepository.Delete(ctx, id)
+	})
+}
+
+// tracedCredentialRepository records a span for every call to a
+// CredentialRepository.
+type tracedCredentialRepository struct{ CredentialRepository }
+
+func (t tracedCredentialRepository) Password(ctx context.Context, userID string) (string, error) {
+	return telemetry.TraceStorage(ctx, "CredentialRepository.Password", storageDriver, ErrNotFound, func(ctx context.Context) (string, error) {
+		return t.CredentialRepository.Password(ctx, userID)
+	})
+}
+
+func (t tracedCredentialRepository) SetPassword(ctx context.Context, userID, hash string) error {
+	return telemetry.TraceStorageErr(ctx, "CredentialRepository.SetPassword", storageDriver, ErrNotFound, func(ctx context.Context) error {
+		return t.CredentialRepository.SetPassword(ctx, userID, hash)
+	})
+}
+
+func (t tracedCredentialRepository) RemoveUser(ctx context.Context, userID string) error {
+	return telemetry.TraceStorageErr(ctx, "CredentialRepository.RemoveUser", storageDriver, ErrNotFound, func(ctx context.Context) error {
+		return t.CredentialRepository.RemoveUser(ctx, userID)
+	})
+}
+
+func (t tracedCredentialRepository) AddRefreshToken(ctx context.Context, rt RefreshToken) error {
+	return telemetry.TraceStorageErr(ctx, "CredentialRepository.AddRefreshToken", storageDriver, ErrNotFound, func(ctx context.Context) error {
+		return t.CredentialRepository.AddRefreshToken(ctx, rt)
+	})
+}
+
+func (t tracedCredentialRepository) UseRefreshToken(ctx context.Context, hash string, now time.Time) (RefreshToken, error) {
+	return telemetry.TraceStorage(ctx, "CredentialRepository.UseRefreshToken", storageDriver, ErrNotFound, func(ctx context.Context) (RefreshToken, error) {
+		return t.CredentialRepository.UseRefreshToken(ctx, hash, now)
+	})
+}
+
+func (t tracedCredentialRepository) RevokeRefreshToken(ctx context.Context, hash string) error {
+	return telemetry.TraceStorageErr(ctx, "CredentialRepository.RevokeRefreshToken", storageDriver, ErrNotFound, func(ctx context.Context) error {
+		return t.CredentialRepository.RevokeRefreshToken(ctx, hash)
+	})
+}
+
+func (t tracedCredentialRepository) RevokeRefreshTokens(ctx context.Context, userID string) error {
+	return telemetry.TraceStorageErr(ctx, "CredentialRepository.RevokeRefreshTokens", storageDriver, ErrNotFound, func(ctx context.Context) error {
+		return t.CredentialRepository.RevokeRefreshTokens(ctx, userID)
+	})
+}